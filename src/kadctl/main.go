@@ -0,0 +1,65 @@
+/*
+ * Command-line client for a node running with -control. Sends the commands
+ * given as arguments, or one per line read from stdin, to the node's control
+ * socket and prints the replies.
+ */
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+import (
+	"kademlia"
+)
+
+func main() {
+	controlPath := flag.String("control", "", "path of the node's control socket")
+	flag.Parse()
+	if *controlPath == "" {
+		log.Fatal("usage: kadctl -control path [command ...]")
+	}
+	client, err := kademlia.DialControl(*controlPath)
+	if err != nil {
+		log.Fatal("Control: ", err)
+	}
+	defer client.Close()
+
+	// One-shot mode for scripts, failing if the node answers with an error.
+	if flag.NArg() > 0 {
+		resp, err := client.Execute(strings.Join(flag.Args(), " "))
+		if err != nil {
+			log.Fatal("Control: ", err)
+		}
+		if resp != "" {
+			fmt.Println(resp)
+		}
+		if strings.HasPrefix(resp, "ERR") || strings.HasPrefix(resp, "usage") {
+			os.Exit(1)
+		}
+		return
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		resp, err := client.Execute(line)
+		if err != nil {
+			log.Fatal("Control: ", err)
+		}
+		if resp != "" {
+			fmt.Println(resp)
+		}
+		if resp == kademlia.ControlQuitReply {
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package kademlia
+
+// Contains address handling for dual-stack and multi-homed nodes: resolving
+// host:port strings, listening on several addresses, dialing a contact through
+// each of its known addresses until one answers, and picking the local address
+// outgoing connections come from so peers see the interface they can reach.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for one address to accept a connection and answer the
+// CONNECT, unless Config says otherwise.
+const dialTimeout = time.Second * 2
+
+type Address struct {
+	Host net.IP
+	Port uint16
+}
+
+func (a Address) String() string {
+	return net.JoinHostPort(a.Host.String(), strconv.Itoa(int(a.Port)))
+}
+
+func (a Address) Equal(o Address) bool {
+	return a.Host.Equal(o.Host) && a.Port == o.Port
+}
+
+// Resolve a host:port string into every IPv4 and IPv6 address it names, IPv4
+// first.
+func ResolveAddresses(hostport string) ([]Address, error) {
+	hostname, portstr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrStrings, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(ipAddrStrings))
+	for _, each := range ipAddrStrings {
+		if ip := net.ParseIP(each); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return sortAddresses(ips, uint16(port)), nil
+}
+
+func sortAddresses(ips []net.IP, port uint16) []Address {
+	addrs := make([]Address, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, Address{ip, port})
+	}
+	return ipv4First(addrs)
+}
+
+// Reorder addrs with the IPv4 ones first, keeping their order otherwise.
+func ipv4First(addrs []Address) []Address {
+	result := make([]Address, 0, len(addrs))
+	for _, a := range addrs {
+		if a.Host.To4() != nil {
+			result = append(result, a)
+		}
+	}
+	for _, a := range addrs {
+		if a.Host.To4() == nil {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// Split a comma-separated list of host:port strings, ignoring blanks.
+func splitAddressList(list string) []string {
+	result := make([]string, 0)
+	for _, each := range strings.Split(list, ",") {
+		if each = strings.TrimSpace(each); each != "" {
+			result = append(result, each)
+		}
+	}
+	return result
+}
+
+// Resolve a comma-separated list of host:port strings, IPv4 first.
+func resolveAddressList(list string) ([]Address, error) {
+	result := make([]Address, 0)
+	for _, each := range splitAddressList(list) {
+		addrs, err := ResolveAddresses(each)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, addrs...)
+	}
+	return ipv4First(result), nil
+}
+
+// Listen on each address of a comma-separated list, as listenOne does.
+func listenAll(laddrs string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0)
+	for _, laddr := range splitAddressList(laddrs) {
+		ls, err := listenOne(laddr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ls...)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	return listeners, nil
+}
+
+// Listen on every address the host part of laddr resolves to, so a name like
+// localhost gets both an IPv4 and an IPv6 listener. Literal IPs and empty
+// hosts are passed straight to net.Listen.
+func listenOne(laddr string) ([]net.Listener, error) {
+	hostname, port, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" || net.ParseIP(hostname) != nil {
+		l, err := net.Listen("tcp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	ipAddrStrings, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]net.Listener, 0, len(ipAddrStrings))
+	for _, each := range ipAddrStrings {
+		l, e := net.Listen("tcp", net.JoinHostPort(each, port))
+		if e != nil {
+			// the host may not have this address family configured
+			err = e
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// The addresses other nodes can reach us on. Wildcard listeners advertise
+// every non link-local interface address. Loopback addresses are left out
+// unless there is nothing else, a remote peer dialing them reaches itself.
+func listenerAddresses(listeners []net.Listener) []Address {
+	addrs := make([]Address, 0)
+	for _, l := range listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		port := uint16(addr.Port)
+		if !addr.IP.IsUnspecified() {
+			addrs = append(addrs, Address{addr.IP, port})
+			continue
+		}
+		ifaddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			addrs = append(addrs, Address{addr.IP, port})
+			continue
+		}
+		for _, each := range ifaddrs {
+			if ipnet, ok := each.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, Address{ipnet.IP, port})
+			}
+		}
+	}
+	remote := make([]Address, 0, len(addrs))
+	for _, each := range addrs {
+		if !each.Host.IsLoopback() {
+			remote = append(remote, each)
+		}
+	}
+	if len(remote) > 0 {
+		addrs = remote
+	}
+	return ipv4First(addrs)
+}
+
+// The local addresses outgoing connections may come from, each with the
+// network of the interface it is on.
+type sourceAddresses []net.IPNet
+
+// Collect the addresses of the listeners bound to a specific IP. Wildcard
+// listeners leave the choice to the kernel.
+func listenerSources(listeners []net.Listener) sourceAddresses {
+	ifaddrs, _ := net.InterfaceAddrs()
+	sources := make(sourceAddresses, 0)
+	for _, l := range listeners {
+		ip := l.Addr().(*net.TCPAddr).IP
+		if ip.IsUnspecified() {
+			continue
+		}
+		source := net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		for _, each := range ifaddrs {
+			if ipnet, ok := each.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				source.Mask = ipnet.Mask
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// The source address for a connection to peer: a listening address on the
+// same network as the peer, else nil to let the kernel choose by its routes.
+// Loopback peers always get nil: the kernel answers them from loopback
+// anyway, and binding before connecting keeps it from reusing ports of closed
+// connections.
+func (s sourceAddresses) pick(peer net.IP) net.IP {
+	if peer.IsLoopback() {
+		return nil
+	}
+	for _, each := range s {
+		if (each.IP.To4() != nil) == (peer.To4() != nil) && each.Contains(peer) {
+			return each.IP
+		}
+	}
+	return nil
+}
+
+// Connect to the RPC endpoint at a from source, or from any local address if
+// source is nil. Does what rpc.DialHTTPPath does with a bound dialer, giving
+// up if the connection is not set up within timeout.
+func dialAddress(a Address, source net.IP, timeout time.Duration) (*rpc.Client, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	conn, err := dialer.Dial("tcp", a.String())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	path := rpc.DefaultRPCPath + strconv.Itoa(int(a.Port))
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		conn.SetDeadline(time.Time{})
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, err
+}
+
+// Dial each of the addresses in turn until one accepts the connection,
+// binding each attempt to the source picked for it.
+func dialAddressesFrom(sources sourceAddresses, addrs []Address, timeout time.Duration) (*rpc.Client, error) {
+	err := errors.New("no known address")
+	for _, a := range addrs {
+		client, e := dialAddress(a, sources.pick(a.Host), timeout)
+		if e == nil {
+			return client, nil
+		}
+		err = e
+	}
+	return nil, err
+}
+
+// Dial from any local address.
+func dialAddresses(addrs []Address) (*rpc.Client, error) {
+	return dialAddressesFrom(nil, addrs, dialTimeout)
+}
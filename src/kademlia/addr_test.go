@@ -0,0 +1,121 @@
+package kademlia
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_ContactAddresses(t *testing.T) {
+	c := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, []Address{
+		{net.IPv4(127, 0, 0, 1), 7000},
+		{net.IPv6loopback, 7000},
+	}}
+	addrs := c.Addresses()
+	assertIntEqual(2, len(addrs), "Duplicate address not removed", t)
+	assertStringEqual("127.0.0.1:7000", addrs[0].String(), "Preferred address not first", t)
+	assertStringEqual("[::1]:7000", addrs[1].String(), "IPv6 address wrongly formatted", t)
+}
+
+/*
+ * A remote sender's loopback addresses lead back to this host, so only its
+ * other addresses are kept. Local senders keep theirs.
+ */
+func Test_ReachableSender(t *testing.T) {
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, []Address{
+		{net.IPv4(10, 0, 0, 9), 7000},
+		{net.IPv6loopback, 7000},
+	}}
+	remote := &KademliaCore{instance[0], net.IPv4(10, 0, 0, 9)}
+	c, ok := remote.reachable(sender)
+	assertTrue(ok, "Sender with a remote address dropped", t)
+	assertIntEqual(1, len(c.Addresses()), "Loopback addresses kept", t)
+	assertStringEqual("10.0.0.9:7000", c.Addresses()[0].String(), "Wrong address kept", t)
+	_, ok = remote.reachable(Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil})
+	assertFalse(ok, "Sender with only loopback addresses kept", t)
+
+	local := &KademliaCore{instance[0], net.IPv4(127, 0, 0, 1)}
+	c, ok = local.reachable(sender)
+	assertTrue(ok && len(c.Addresses()) == 3, "Local sender lost addresses", t)
+}
+
+/*
+ * Ping a contact whose preferred address is dead, the next one should be
+ * tried.
+ */
+func Test_DialFallback(t *testing.T) {
+	target := instance[2].SelfContact
+	c := Contact{target.NodeID, net.IPv4(127, 0, 0, 1), 1, target.Addresses()}
+	assertContains(
+		instance[1].DoPingAddresses(c.Addresses()),
+		"OK: Ping "+target.NodeID.AsString(),
+		"Did not fall back to the second address",
+		t)
+}
+
+func Test_PingIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	l.Close()
+	k6 := NewKademlia("[::1]:7960")
+	assertTrue(k6.SelfContact.Host.To4() == nil, "IPv6 node advertises IPv4 address", t)
+	assertContains(
+		instance[0].DoPing(net.IPv6loopback, 7960),
+		"OK: Ping "+k6.NodeID.AsString(),
+		"Cannot ping IPv6 node",
+		t)
+}
+
+func Test_MultipleListenAddresses(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Advertise = "127.0.0.1:7980"
+	k := NewKademliaWithConfig("127.0.0.1:7979, 127.0.0.1:7980", conf)
+	assertIntEqual(2, len(k.listenAddrs), "Not listening on both addresses", t)
+	assertIntEqual(1, len(k.SelfContact.Addresses()), "Listen addresses advertised", t)
+	assertIntEqual(7980, int(k.SelfContact.Port), "Wrong port advertised", t)
+	for _, port := range []uint16{7979, 7980} {
+		assertContains(
+			instance[0].DoPing(net.IPv4(127, 0, 0, 1), port),
+			"OK: Ping "+k.NodeID.AsString(),
+			"Cannot ping node on port "+strconv.Itoa(int(port)),
+			t)
+	}
+	conf.Advertise = "127.0.0.1"
+	assertTrue(conf.Validate() != nil, "Advertised address without port accepted", t)
+}
+
+func Test_SourceAddress(t *testing.T) {
+	sources := sourceAddresses{
+		{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(24, 32)},
+		{IP: net.IPv4(192, 168, 1, 5), Mask: net.CIDRMask(24, 32)},
+		{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)},
+	}
+	pick := func(ip net.IP) string { return sources.pick(ip).String() }
+	assertStringEqual("192.168.1.5", pick(net.IPv4(192, 168, 1, 9)), "Source not on the peer's network", t)
+	assertTrue(sources.pick(net.IPv4(8, 8, 8, 8)) == nil, "Source picked for peer outside every network", t)
+	assertTrue(sources.pick(net.IPv4(127, 0, 0, 1)) == nil, "Source picked for loopback peer", t)
+	assertTrue(sources.pick(net.IPv6loopback) == nil, "IPv4 source picked for IPv6 peer", t)
+
+	client, err := dialAddress(Address{net.IPv4(127, 0, 0, 1), instance[0].SelfContact.Port}, net.IPv4(127, 0, 0, 1), dialTimeout)
+	assertTrue(err == nil, "Cannot dial from a bound source", t)
+	if client != nil {
+		client.Close()
+	}
+}
+
+// A peer that accepts connections but never answers the CONNECT must not
+// stall the caller past the dial timeout.
+func Test_DialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:7993")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	start := time.Now()
+	_, err = dialAddress(Address{net.IPv4(127, 0, 0, 1), 7993}, nil, 100*time.Millisecond)
+	assertTrue(err != nil, "Silent peer dialed", t)
+	assertTrue(time.Since(start) < time.Second, "Dial outlived its timeout", t)
+}
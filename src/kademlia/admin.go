@@ -0,0 +1,328 @@
+package kademlia
+
+// Contains the optional HTTP/JSON admin gateway. Its endpoints mirror the CLI
+// commands in main so that dashboards and other services can drive a node
+// without scraping stdout. Every endpoint answers with a JSON object carrying
+// an "ok" flag; operations that take arguments are POSTs with a JSON body.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const AdminPrefix = "/api/"
+
+type ContactJSON struct {
+	NodeID string   `json:"node_id"`
+	Host   string   `json:"host"`
+	Port   uint16   `json:"port"`
+	Addrs  []string `json:"addrs,omitempty"`
+	// from the contact's last PING or PONG, when known
+	Version      uint8      `json:"version,omitempty"`
+	Capabilities string     `json:"capabilities,omitempty"`
+	LastSeen     *time.Time `json:"last_seen,omitempty"` // routing table contacts only
+}
+
+func NewContactJSON(c Contact) ContactJSON {
+	result := ContactJSON{NodeID: c.NodeID.AsString(), Host: c.Host.String(), Port: c.Port}
+	for _, each := range c.Addrs {
+		result.Addrs = append(result.Addrs, each.String())
+	}
+	return result
+}
+
+func contactsJSON(contacts []Contact) []ContactJSON {
+	result := make([]ContactJSON, 0, len(contacts))
+	for _, each := range contacts {
+		result = append(result, NewContactJSON(each))
+	}
+	return result
+}
+
+type AdminRequest struct {
+	NodeID     string `json:"node_id"`
+	Address    string `json:"address"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	VdoID      string `json:"vdo_id"`
+	NumberKeys byte   `json:"number_keys"`
+	Threshold  byte   `json:"threshold"`
+	Timeout    byte   `json:"timeout"`
+}
+
+type AdminResponse struct {
+	OK       bool           `json:"ok"`
+	Response string         `json:"response,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	NodeID   string         `json:"node_id,omitempty"`
+	Contact  *ContactJSON   `json:"contact,omitempty"`
+	Contacts []ContactJSON  `json:"contacts,omitempty"`
+	Value    *string        `json:"value,omitempty"`
+	Keys     []LocalKeyJSON `json:"keys,omitempty"`
+}
+
+type LocalKeyJSON struct {
+	Key    string    `json:"key"`
+	Size   int       `json:"size"`
+	Stored time.Time `json:"stored"`
+	Age    float64   `json:"age_seconds"`
+	Origin string    `json:"origin"`
+	From   string    `json:"from,omitempty"`
+	// cached copies only
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Build a response from one of the "OK: ..." / "ERR: ..." strings returned by
+// the Do* functions.
+func responseFromString(s string) AdminResponse {
+	return AdminResponse{OK: strings.HasPrefix(s, "OK:"), Response: strings.TrimSpace(s)}
+}
+
+func adminError(status int, msg string) (int, AdminResponse) {
+	return status, AdminResponse{OK: false, Error: msg}
+}
+
+type adminFunc func(req AdminRequest) (int, AdminResponse)
+
+func adminEndpoint(method string, fn adminFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status int
+		var res AdminResponse
+		var req AdminRequest
+		if r.Method != method {
+			status, res = adminError(http.StatusMethodNotAllowed, "use "+method)
+		} else if method == "POST" && json.NewDecoder(r.Body).Decode(&req) != nil {
+			status, res = adminError(http.StatusBadRequest, "invalid JSON body")
+		} else {
+			status, res = fn(req)
+		}
+		writeAdminResponse(w, status, res)
+	})
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, res AdminResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Parse an ID field of the request, naming the field in the error.
+func parseAdminID(value, field string) (ID, error) {
+	id, err := IDFromString(value)
+	if err != nil || value == "" {
+		return id, &AdminFieldError{field, value}
+	}
+	return id, nil
+}
+
+type AdminFieldError struct {
+	field string
+	value string
+}
+
+func (e *AdminFieldError) Error() string {
+	return "invalid " + e.field + " (" + e.value + ")"
+}
+
+func (k *Kademlia) adminContact(value string) (*Contact, int, error) {
+	id, err := parseAdminID(value, "node_id")
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	c, err := k.FindContact(id)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	return c, http.StatusOK, nil
+}
+
+// Return a handler serving the admin gateway under AdminPrefix.
+func (k *Kademlia) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(name, method string, fn adminFunc) {
+		mux.Handle(AdminPrefix+name, adminEndpoint(method, fn))
+	}
+
+	handle("whoami", "GET", func(req AdminRequest) (int, AdminResponse) {
+		self := NewContactJSON(k.SelfContact)
+		return http.StatusOK, AdminResponse{OK: true, NodeID: k.NodeID.AsString(), Contact: &self}
+	})
+	handle("contacts", "GET", func(req AdminRequest) (int, AdminResponse) {
+		contacts := contactsJSON(k.AddrBook.Contacts())
+		for i := range contacts {
+			id, _ := IDFromString(contacts[i].NodeID)
+			if info, ok := k.AddrBook.PeerInfo(id); ok {
+				contacts[i].Version = info.Version
+				contacts[i].Capabilities = info.Capabilities.String()
+			}
+			if seen, ok := k.AddrBook.LastSeen(id); ok {
+				contacts[i].LastSeen = &seen
+			}
+		}
+		return http.StatusOK, AdminResponse{OK: true, Contacts: contacts}
+	})
+	handle("local_keys", "GET", func(req AdminRequest) (int, AdminResponse) {
+		infos := k.LocalKeys()
+		keys := make([]LocalKeyJSON, 0, len(infos))
+		now := k.Clock.Now()
+		for _, info := range infos {
+			each := LocalKeyJSON{info.Key.AsString(), info.Size, info.Stored,
+				now.Sub(info.Stored).Seconds(), info.Origin.Kind, "", nil}
+			if info.Origin.NodeID != (ID{}) {
+				each.From = info.Origin.NodeID.AsString()
+			}
+			if !info.Expires.IsZero() {
+				expires := info.Expires
+				each.Expires = &expires
+			}
+			keys = append(keys, each)
+		}
+		return http.StatusOK, AdminResponse{OK: true, Keys: keys}
+	})
+	// the archive is the body itself rather than a field of AdminResponse
+	mux.HandleFunc(AdminPrefix+"export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeAdminResponse(w, http.StatusMethodNotAllowed, AdminResponse{OK: false, Error: "use GET"})
+			return
+		}
+		// a failed export must not reach the client as a truncated 200
+		var buf bytes.Buffer
+		if err := k.ExportData(&buf); err != nil {
+			writeAdminResponse(w, http.StatusInternalServerError, AdminResponse{OK: false, Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc(AdminPrefix+"import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeAdminResponse(w, http.StatusMethodNotAllowed, AdminResponse{OK: false, Error: "use POST"})
+			return
+		}
+		values, vdos, err := k.ImportData(r.Body)
+		if err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, AdminResponse{OK: false, Error: err.Error()})
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, AdminResponse{OK: true,
+			Response: fmt.Sprintf("OK: Imported %d values and %d VDOs", values, vdos)})
+	})
+	handle("ping", "POST", func(req AdminRequest) (int, AdminResponse) {
+		if req.NodeID != "" {
+			c, status, err := k.adminContact(req.NodeID)
+			if err != nil {
+				return adminError(status, err.Error())
+			}
+			return http.StatusOK, responseFromString(k.DoPingAddresses(c.Addresses()))
+		}
+		if _, _, err := net.SplitHostPort(req.Address); err != nil {
+			return adminError(http.StatusBadRequest, "need node_id or host:port address")
+		}
+		addrs, err := ResolveAddresses(req.Address)
+		if err != nil {
+			return adminError(http.StatusBadRequest, "could not resolve "+req.Address)
+		}
+		return http.StatusOK, responseFromString(k.DoPingAddresses(addrs))
+	})
+	handle("store", "POST", func(req AdminRequest) (int, AdminResponse) {
+		c, status, err := k.adminContact(req.NodeID)
+		if err != nil {
+			return adminError(status, err.Error())
+		}
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		return http.StatusOK, responseFromString(k.DoStore(c, key, []byte(req.Value)))
+	})
+	handle("find_node", "POST", func(req AdminRequest) (int, AdminResponse) {
+		c, status, err := k.adminContact(req.NodeID)
+		if err != nil {
+			return adminError(status, err.Error())
+		}
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		return http.StatusOK, responseFromString(k.DoFindNode(c, key))
+	})
+	handle("find_value", "POST", func(req AdminRequest) (int, AdminResponse) {
+		c, status, err := k.adminContact(req.NodeID)
+		if err != nil {
+			return adminError(status, err.Error())
+		}
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		return http.StatusOK, responseFromString(k.DoFindValue(c, key))
+	})
+	handle("local_find_value", "POST", func(req AdminRequest) (int, AdminResponse) {
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		value, err := k.getData(key)
+		if err != nil {
+			return http.StatusOK, AdminResponse{OK: false, Error: "not found"}
+		}
+		s := string(value)
+		return http.StatusOK, AdminResponse{OK: true, Value: &s}
+	})
+	handle("iterative_find_node", "POST", func(req AdminRequest) (int, AdminResponse) {
+		id, err := parseAdminID(req.NodeID, "node_id")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		return http.StatusOK, AdminResponse{OK: true, Contacts: contactsJSON(k.iterativeFindNode(id))}
+	})
+	handle("iterative_store", "POST", func(req AdminRequest) (int, AdminResponse) {
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		stored := k.iterativeStore(key, []byte(req.Value))
+		return http.StatusOK, AdminResponse{OK: len(stored) > 0, Contacts: contactsJSON(stored)}
+	})
+	handle("iterative_find_value", "POST", func(req AdminRequest) (int, AdminResponse) {
+		key, err := parseAdminID(req.Key, "key")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		contacts, value := k.iterativeFindValue(key)
+		if value == nil {
+			return http.StatusOK, AdminResponse{OK: false, Error: "not found", Contacts: contactsJSON(contacts)}
+		}
+		stored := k.cacheValue(key, value, contacts)
+		found := string(value)
+		return http.StatusOK, AdminResponse{OK: true, Value: &found, Contacts: contactsJSON(stored)}
+	})
+	handle("vanish", "POST", func(req AdminRequest) (int, AdminResponse) {
+		vdoId, err := parseAdminID(req.VdoID, "vdo_id")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		if req.Threshold == 0 || req.NumberKeys < req.Threshold {
+			return adminError(http.StatusBadRequest, "need 0 < threshold <= number_keys")
+		}
+		return http.StatusOK, responseFromString(
+			k.DoVanish(vdoId, []byte(req.Value), req.NumberKeys, req.Threshold, req.Timeout))
+	})
+	handle("unvanish", "POST", func(req AdminRequest) (int, AdminResponse) {
+		c, status, err := k.adminContact(req.NodeID)
+		if err != nil {
+			return adminError(status, err.Error())
+		}
+		vdoId, err := parseAdminID(req.VdoID, "vdo_id")
+		if err != nil {
+			return adminError(http.StatusBadRequest, err.Error())
+		}
+		return http.StatusOK, responseFromString(k.DoUnvanish(c, vdoId))
+	})
+	return mux
+}
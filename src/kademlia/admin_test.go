@@ -0,0 +1,69 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func adminCall(t *testing.T, url, method string, req interface{}) (int, AdminResponse) {
+	var body bytes.Buffer
+	if req != nil {
+		json.NewEncoder(&body).Encode(req)
+	}
+	r, _ := http.NewRequest(method, url, &body)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res AdminResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, res
+}
+
+func Test_AdminWhoami(t *testing.T) {
+	srv := httptest.NewServer(instance[0].AdminHandler())
+	defer srv.Close()
+	status, res := adminCall(t, srv.URL+AdminPrefix+"whoami", "GET", nil)
+	assertIntEqual(http.StatusOK, status, "whoami failed", t)
+	assertStringEqual(instance[0].NodeID.AsString(), res.NodeID, "whoami returned wrong ID", t)
+
+	status, _ = adminCall(t, srv.URL+AdminPrefix+"whoami", "POST", nil)
+	assertIntEqual(http.StatusMethodNotAllowed, status, "Wrong method accepted", t)
+}
+
+func Test_AdminIterativeStoreFind(t *testing.T) {
+	srv1 := httptest.NewServer(instance[3].AdminHandler())
+	defer srv1.Close()
+	srv2 := httptest.NewServer(instance[4].AdminHandler())
+	defer srv2.Close()
+	key := NewRandomID().AsString()
+
+	status, res := adminCall(t, srv1.URL+AdminPrefix+"iterative_store", "POST",
+		AdminRequest{Key: key, Value: "admin"})
+	assertIntEqual(http.StatusOK, status, "iterative_store failed", t)
+	assertTrue(res.OK && len(res.Contacts) > 0, "Value not stored anywhere", t)
+
+	status, res = adminCall(t, srv2.URL+AdminPrefix+"iterative_find_value", "POST",
+		AdminRequest{Key: key})
+	assertIntEqual(http.StatusOK, status, "iterative_find_value failed", t)
+	assertTrue(res.OK && res.Value != nil && *res.Value == "admin", "Stored value not found", t)
+}
+
+func Test_AdminBadRequest(t *testing.T) {
+	srv := httptest.NewServer(instance[0].AdminHandler())
+	defer srv.Close()
+	status, res := adminCall(t, srv.URL+AdminPrefix+"store", "POST",
+		AdminRequest{NodeID: "not-hex", Key: NewRandomID().AsString()})
+	assertIntEqual(http.StatusBadRequest, status, "Invalid node ID accepted", t)
+	assertFalse(res.OK, "Error response marked ok", t)
+
+	status, _ = adminCall(t, srv.URL+AdminPrefix+"store", "POST",
+		AdminRequest{NodeID: NewRandomID().AsString(), Key: NewRandomID().AsString()})
+	assertIntEqual(http.StatusNotFound, status, "Unknown contact not reported", t)
+}
@@ -0,0 +1,142 @@
+package kademlia
+
+// Contains the join procedure: ping a list of seed nodes with retries, look
+// up our own ID and then refresh every bucket farther away than our closest
+// neighbour.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Defaults for Config.BootstrapAttempts and Config.BootstrapBackoff.
+const (
+	bootstrapAttempts = 3
+	bootstrapBackoff  = time.Millisecond * 500
+)
+
+// How well a Bootstrap call joined the network.
+type BootstrapResult struct {
+	Seeds     int // seeds given
+	Reached   int // seeds that answered a ping
+	Refreshed int // buckets refreshed after the self lookup
+	Contacts  int // contacts in the routing table afterwards
+}
+
+func (r BootstrapResult) String() string {
+	return fmt.Sprintf(
+		"joined via %d/%d seeds, %d contacts, %d buckets refreshed",
+		r.Reached, r.Seeds, r.Contacts, r.Refreshed)
+}
+
+// Read a seed file: one host:port per line, blank lines and lines starting
+// with # are ignored.
+func ReadSeedFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seeds := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
+
+// Join the network through the given seeds, each a host:port or a
+// comma-separated list of one node's addresses. With no seeds the node
+// starts a new network on its own. An error is returned only if seeds were
+// given and none of them answered.
+func (k *Kademlia) Bootstrap(seeds []string) (BootstrapResult, error) {
+	result := BootstrapResult{Seeds: len(seeds)}
+	if len(seeds) == 0 {
+		return result, nil
+	}
+
+	resCh := make(chan bool, len(seeds))
+	for _, seed := range seeds {
+		go func(seed string) {
+			resCh <- k.pingSeed(seed)
+		}(seed)
+	}
+	for range seeds {
+		if <-resCh {
+			result.Reached++
+		}
+	}
+	if result.Reached == 0 {
+		return result, errors.New("no seed answered")
+	}
+
+	k.iterativeFindNode(k.NodeID)
+	result.Refreshed = k.refreshFartherBuckets()
+	result.Contacts = len(k.AddrBook.Contacts())
+	return result, nil
+}
+
+func (k *Kademlia) pingSeed(seed string) bool {
+	backoff := k.Config.BootstrapBackoff
+	for attempt := 0; attempt < k.Config.BootstrapAttempts; attempt++ {
+		if attempt > 0 {
+			<-k.Clock.After(backoff)
+			backoff *= 2
+		}
+		addrs, err := resolveAddressList(seed)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(k.DoPingAddresses(addrs), "OK:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up a random ID in every bucket farther away than the closest
+// non-empty one. Returns the number of buckets refreshed.
+func (k *Kademlia) refreshFartherBuckets() int {
+	buckets := k.AddrBook.Buckets()
+	closest := -1
+	for i := b - 1; i >= 0; i-- {
+		if len(buckets[i]) > 0 {
+			closest = i
+			break
+		}
+	}
+	for i := 0; i < closest; i++ {
+		k.iterativeFindNode(RandomIDInBucket(k.NodeID, i))
+	}
+	if closest < 0 {
+		return 0
+	}
+	return closest
+}
+
+// Generate a random ID sharing exactly index leading bits with self, so it
+// falls in bucket index of self's routing table.
+func RandomIDInBucket(self ID, index int) ID {
+	ret := NewRandomID()
+	for i := 0; i < index/8; i++ {
+		ret[i] = self[i]
+	}
+	byteIndex := index / 8
+	if byteIndex < IDBytes {
+		bit := uint8(7 - index%8)
+		// bits before index come from self, bit index is flipped
+		high := ^uint8(0) << (bit + 1)
+		ret[byteIndex] = (self[byteIndex] & high) |
+			((^self[byteIndex]) & (1 << bit)) |
+			(ret[byteIndex] & ((1 << bit) - 1))
+	}
+	return ret
+}
@@ -0,0 +1,49 @@
+package kademlia
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_RandomIDInBucket(t *testing.T) {
+	self := NewRandomID()
+	for i := 0; i < b; i++ {
+		id := RandomIDInBucket(self, i)
+		assertIntEqual(i, id.Xor(self).PrefixLen(), "ID generated in wrong bucket", t)
+	}
+}
+
+func Test_BootstrapNoSeeds(t *testing.T) {
+	k := NewKademlia("localhost:7962")
+	result, err := k.Bootstrap(nil)
+	assertTrue(err == nil, "First node of a network failed to bootstrap", t)
+	assertIntEqual(0, result.Contacts, "First node has contacts", t)
+}
+
+/*
+ * Join through one dead and one live seed, the dead one should be retried and
+ * the node should still end up with a populated routing table. The live seed
+ * knows only one other node, so it has room for the new one.
+ */
+func Test_Bootstrap(t *testing.T) {
+	seed := NewKademlia("localhost:7984")
+	seed.DoPing(instance[0].SelfContact.Host, instance[0].SelfContact.Port)
+	k := NewKademlia("localhost:7963")
+	seeds := []string{
+		"localhost:7964",
+		"localhost:" + strconv.Itoa(int(seed.SelfContact.Port)),
+	}
+	result, err := k.Bootstrap(seeds)
+	assertTrue(err == nil, "Bootstrap failed with a live seed", t)
+	assertIntEqual(1, result.Reached, "Wrong number of seeds reached", t)
+	assertTrue(result.Contacts > 1, "Self lookup found no contacts", t)
+	// the seed adds the new node after answering its ping
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if _, err = seed.FindContact(k.NodeID); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assertTrue(err == nil, "Seed does not know the new node", t)
+}
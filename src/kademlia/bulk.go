@@ -0,0 +1,251 @@
+package kademlia
+
+// Contains the bulk loader used to seed networks with datasets. Records are
+// read from JSONL or CSV files and stored (or verified) by a pool of workers,
+// each running ordinary iterative stores and lookups.
+//
+// JSONL lines look like {"key": "...", "value": "..."} or
+// {"key": "...", "file": "path"}. CSV rows are key,value or key,,path, with an
+// optional "key,value,file" header. Keys that are not 40 hex digits are
+// hashed with SHA-1, and file paths are relative to the dataset file.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bulkParallelism = 8
+	bulkRetries     = 3
+	bulkBackoff     = time.Millisecond * 200
+)
+
+type BulkRecord struct {
+	Key   ID
+	Name  string // the key as written in the dataset
+	Value []byte
+}
+
+type BulkResult struct {
+	Record   BulkRecord
+	Replicas int // nodes that accepted the value, or 1 if verify found it
+	Attempts int
+	Err      error
+}
+
+// Turn a dataset key into an ID, hashing it unless it already is one.
+func BulkKey(name string) ID {
+	if len(name) == 2*IDBytes {
+		if _, err := hex.DecodeString(name); err == nil {
+			id, _ := IDFromString(name)
+			return id
+		}
+	}
+	var id ID
+	sum := sha1.Sum([]byte(name))
+	copy(id[:], sum[:])
+	return id
+}
+
+// Read a dataset, as CSV if the file name ends in .csv and as JSONL otherwise.
+func ReadBulkFile(path string) ([]BulkRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(path)
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return readBulkCSV(f, dir)
+	}
+	return readBulkJSONL(f, dir)
+}
+
+func bulkRecord(line int, name, value, file, dir string) (BulkRecord, error) {
+	if name == "" {
+		return BulkRecord{}, fmt.Errorf("line %d: missing key", line)
+	}
+	record := BulkRecord{BulkKey(name), name, []byte(value)}
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return record, fmt.Errorf("line %d: %v", line, err)
+		}
+		record.Value = data
+	}
+	return record, nil
+}
+
+func readBulkJSONL(r io.Reader, dir string) ([]BulkRecord, error) {
+	records := make([]BulkRecord, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var entry struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			File  string `json:"file"`
+		}
+		if err := json.Unmarshal(text, &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		record, err := bulkRecord(line, entry.Key, entry.Value, entry.File, dir)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func readBulkCSV(r io.Reader, dir string) ([]BulkRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]BulkRecord, 0, len(rows))
+	for i, row := range rows {
+		if i == 0 && len(row) > 0 && strings.EqualFold(row[0], "key") {
+			continue
+		}
+		if len(row) < 2 || len(row) > 3 {
+			return nil, fmt.Errorf("line %d: want key,value or key,,file", i+1)
+		}
+		file := ""
+		if len(row) == 3 {
+			file = row[2]
+		}
+		record, err := bulkRecord(i+1, row[0], row[1], file, dir)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Run fn on every record with up to parallelism workers, retrying failures
+// with a doubling backoff timed by clock. Results are in the order of records.
+func runBulk(clock Clock, records []BulkRecord, parallelism, retries int, fn func(BulkRecord) (int, error)) []BulkResult {
+	if parallelism < 1 {
+		parallelism = bulkParallelism
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	results := make([]BulkResult, len(records))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				result := BulkResult{Record: records[i]}
+				backoff := bulkBackoff
+				for result.Attempts <= retries {
+					if result.Attempts > 0 {
+						<-clock.After(backoff)
+						backoff *= 2
+					}
+					result.Attempts++
+					result.Replicas, result.Err = fn(records[i])
+					if result.Err == nil {
+						break
+					}
+				}
+				results[i] = result
+			}
+		}()
+	}
+	for i := range records {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+// Store every record with iterative stores. A record fails if no node
+// accepted it.
+func (k *Kademlia) BulkStore(records []BulkRecord, parallelism, retries int) []BulkResult {
+	return runBulk(k.Clock, records, parallelism, retries, func(r BulkRecord) (int, error) {
+		stored := k.iterativeStore(r.Key, r.Value)
+		if len(stored) == 0 {
+			return 0, errors.New("no node accepted the value")
+		}
+		return len(stored), nil
+	})
+}
+
+// Look up every record and check the value found matches.
+func (k *Kademlia) BulkVerify(records []BulkRecord, parallelism, retries int) []BulkResult {
+	return runBulk(k.Clock, records, parallelism, retries, func(r BulkRecord) (int, error) {
+		_, value := k.iterativeFindValue(r.Key)
+		switch {
+		case value == nil:
+			return 0, errors.New("not found")
+		case !bytes.Equal(value, r.Value):
+			return 0, errors.New("value differs")
+		}
+		return 1, nil
+	})
+}
+
+// ======================= CLI ===================
+func bulkReport(verb string, results []BulkResult) string {
+	failed := 0
+	lines := make([]string, 0, len(results)+1)
+	for _, each := range results {
+		line := fmt.Sprintf("%s %s replicas=%d attempts=%d",
+			each.Record.Key.AsString(), each.Record.Name, each.Replicas, each.Attempts)
+		if each.Err != nil {
+			failed++
+			line += " err=" + each.Err.Error()
+		}
+		lines = append(lines, line)
+	}
+	summary := fmt.Sprintf("OK: %s %d of %d keys", verb, len(results)-failed, len(results))
+	if failed > 0 {
+		summary = fmt.Sprintf("ERR: %d of %d keys failed", failed, len(results))
+	}
+	return strings.Join(append([]string{summary}, lines...), "\n")
+}
+
+func (k *Kademlia) DoBulkStore(path string, parallelism, retries int) string {
+	records, err := ReadBulkFile(path)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return bulkReport("Stored", k.BulkStore(records, parallelism, retries))
+}
+
+func (k *Kademlia) DoBulkVerify(path string, parallelism, retries int) string {
+	records, err := ReadBulkFile(path)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return bulkReport("Verified", k.BulkVerify(records, parallelism, retries))
+}
@@ -0,0 +1,60 @@
+package kademlia
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_ReadBulkFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "blob.txt", "from a file")
+	id := NewRandomID().AsString()
+	jsonl := writeTestFile(t, dir, "data.jsonl",
+		`{"key": "`+id+`", "value": "by id"}`+"\n\n"+
+			`{"key": "name", "file": "blob.txt"}`+"\n")
+	records, err := ReadBulkFile(jsonl)
+	assertTrue(err == nil, "Could not read JSONL", t)
+	assertIntEqual(2, len(records), "Wrong number of JSONL records", t)
+	assertStringEqual(id, records[0].Key.AsString(), "ID key was hashed", t)
+	assertTrue(records[1].Key.Equals(BulkKey("name")), "Name key not hashed", t)
+	assertStringEqual("from a file", string(records[1].Value), "File value not read", t)
+
+	csv := writeTestFile(t, dir, "data.csv", "key,value,file\na,1\nb,,blob.txt\n")
+	records, err = ReadBulkFile(csv)
+	assertTrue(err == nil, "Could not read CSV", t)
+	assertIntEqual(2, len(records), "Header not skipped", t)
+	assertStringEqual("from a file", string(records[1].Value), "CSV file value not read", t)
+
+	bad := writeTestFile(t, dir, "bad.jsonl", `{"value": "no key"}`)
+	_, err = ReadBulkFile(bad)
+	assertTrue(err != nil, "Record without key accepted", t)
+}
+
+func Test_BulkStoreVerify(t *testing.T) {
+	k := instance[6]
+	records := make([]BulkRecord, 0)
+	for _, name := range []string{"alpha", "beta", "gamma", "delta", "epsilon"} {
+		records = append(records, BulkRecord{BulkKey(name), name, []byte("bulk " + name)})
+	}
+	for _, each := range k.BulkStore(records, 3, 1) {
+		assertTrue(each.Err == nil, "Bulk store failed for "+each.Record.Name, t)
+		assertTrue(each.Replicas > 0, "No replicas for "+each.Record.Name, t)
+	}
+	for _, each := range instance[7].BulkVerify(records, 3, 1) {
+		assertTrue(each.Err == nil, "Bulk verify failed for "+each.Record.Name, t)
+	}
+
+	wrong := []BulkRecord{{BulkKey("alpha"), "alpha", []byte("not what was stored")}}
+	result := instance[7].BulkVerify(wrong, 1, 1)[0]
+	assertTrue(result.Err != nil, "Wrong value verified", t)
+	assertIntEqual(2, result.Attempts, "Failure not retried", t)
+}
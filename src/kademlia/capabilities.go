@@ -0,0 +1,88 @@
+package kademlia
+
+// Contains the capability negotiation done by PING. Each side sends its
+// protocol version (in the envelope) and the optional features it supports,
+// and records the other's in the routing table. Later RPCs only use a feature
+// if both sides support it.
+
+import (
+	"strings"
+)
+
+type Capabilities uint32
+
+const (
+	// Answers PING, STORE, FIND_NODE and FIND_VALUE over UDP.
+	CapUDP Capabilities = 1 << iota
+	// Reports refusals in RPCError result fields instead of failing the RPC.
+	CapErrorCodes
+)
+
+// Supported by every node running this version.
+const baseCapabilities = CapErrorCodes
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapUDP, "udp"},
+	{CapErrorCodes, "error-codes"},
+}
+
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+func (c Capabilities) String() string {
+	names := make([]string, 0)
+	for _, each := range capabilityNames {
+		if c.Has(each.cap) {
+			names = append(names, each.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// What the routing table knows about a peer from its last PING or PONG.
+type PeerInfo struct {
+	Version      uint8
+	Capabilities Capabilities
+}
+
+// Capabilities this node offers.
+func (k *Kademlia) Capabilities() Capabilities {
+	caps := Capabilities(baseCapabilities)
+	if k.udp != nil {
+		caps |= CapUDP
+	}
+	return caps
+}
+
+// Features shared with a peer. Peers we have not exchanged a PING with are
+// assumed to support what their envelope version implies, which is nothing
+// optional for legacy peers.
+func (k *Kademlia) sharedCapabilities(nodeId ID, version uint8) Capabilities {
+	info, ok := k.AddrBook.PeerInfo(nodeId)
+	if !ok {
+		info = PeerInfo{version, impliedCapabilities(version)}
+	}
+	return k.Capabilities() & info.Capabilities
+}
+
+func impliedCapabilities(version uint8) Capabilities {
+	if version == 0 {
+		return 0
+	}
+	return baseCapabilities
+}
+
+// Negotiate down to the lower of the two protocol versions.
+func negotiatedVersion(version uint8) uint8 {
+	if version > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return version
+}
@@ -0,0 +1,119 @@
+package kademlia
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func Test_CapabilitiesString(t *testing.T) {
+	assertStringEqual("none", Capabilities(0).String(), "Empty set", t)
+	assertStringEqual("udp,error-codes", (CapUDP | CapErrorCodes).String(), "Full set", t)
+	assertTrue((CapUDP | CapErrorCodes).Has(CapUDP), "Missing capability", t)
+	assertFalse(CapErrorCodes.Has(CapUDP), "Extra capability", t)
+}
+
+// Wait for the asynchronous routing table update done by the PING handler.
+func waitPeerInfo(k *Kademlia, nodeId ID) (PeerInfo, bool) {
+	for i := 0; i < 50; i++ {
+		if info, ok := k.AddrBook.PeerInfo(nodeId); ok {
+			return info, true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return PeerInfo{}, false
+}
+
+/*
+ * A UDP node pinging a TCP-only node should learn that UDP is not shared,
+ * and both sides should record what the other announced.
+ */
+func Test_PingNegotiation(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UDP = true
+	k1 := NewKademliaWithConfig("localhost:7968", conf)
+	k2 := NewKademlia("localhost:7969")
+	// as if k2 could not bind its UDP sockets
+	k2.udp.Close()
+	k2.udp = nil
+
+	assertContains(
+		k1.DoPingAddresses(k2.SelfContact.Addresses()),
+		"OK: Ping",
+		"Ping failed",
+		t)
+	info, ok := k1.AddrBook.PeerInfo(k2.NodeID)
+	assertTrue(ok, "Pong capabilities not recorded", t)
+	assertIntEqual(ProtocolVersion, int(info.Version), "Wrong negotiated version", t)
+	assertStringEqual("error-codes", info.Capabilities.String(), "Wrong peer capabilities", t)
+	assertFalse(k1.sharedCapabilities(k2.NodeID, 0).Has(CapUDP), "UDP shared with TCP-only peer", t)
+
+	info, ok = waitPeerInfo(k2, k1.NodeID)
+	assertTrue(ok, "Ping capabilities not recorded", t)
+	assertStringEqual("udp,error-codes", info.Capabilities.String(), "Wrong sender capabilities", t)
+
+	key := NewRandomID()
+	assertContains(k1.DoStore(&k2.SelfContact, key, []byte("tcp")), "OK:", "Store to TCP-only peer failed", t)
+}
+
+func Test_PingNewerVersion(t *testing.T) {
+	core := &KademliaCore{instance[5], nil}
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil}
+	ping := PingMessage{sender, NewRandomID(), CapErrorCodes, Envelope{ProtocolVersion + 1, time.Now().Unix()}}
+	var pong PongMessage
+	err := core.Ping(ping, &pong)
+	assertTrue(err == nil, "Ping from newer version refused", t)
+	assertIntEqual(ProtocolVersion, int(pong.Version), "Pong not sent with our version", t)
+}
+
+// Answers PING as a node running a newer protocol version.
+type newerPeer struct {
+	self Contact
+}
+
+func (p *newerPeer) Ping(ping PingMessage, pong *PongMessage) error {
+	pong.MsgID = ping.MsgID
+	pong.Sender = p.self
+	pong.Capabilities = CapErrorCodes
+	pong.Envelope = Envelope{ProtocolVersion + 1, time.Now().Unix()}
+	return nil
+}
+
+func Test_PongNewerVersion(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:7987")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &newerPeer{Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7987, nil}}
+	server := rpc.NewServer()
+	server.RegisterName("KademliaCore", peer)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath+"7987", server)
+	go http.Serve(l, mux)
+
+	k := NewKademlia("localhost:7988")
+	_, err = k.PingAddresses(peer.self.Addresses())
+	assertTrue(err == nil, "Pong from newer version refused", t)
+	info, ok := k.AddrBook.PeerInfo(peer.self.NodeID)
+	assertTrue(ok, "Pong capabilities not recorded", t)
+	assertIntEqual(ProtocolVersion, int(info.Version), "Version not negotiated down", t)
+	assertIntEqual(0, k.Reputation.Violations(peer.self.NodeID.AsString())[BadVersion], "Newer pong counted as misbehaviour", t)
+}
+
+/*
+ * Legacy peers cannot decode an error in the result, so their refused
+ * requests fail the RPC instead.
+ */
+func Test_RefuseLegacyPeer(t *testing.T) {
+	core := &KademliaCore{instance[5], nil}
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil}
+	req := FindNodeRequest{sender, NewRandomID(), NewRandomID(), Envelope{}}
+	var res FindNodeResult
+	assertTrue(core.FindNode(req, &res) == nil, "First request refused", t)
+	res = FindNodeResult{}
+	err := core.FindNode(req, &res)
+	assertTrue(err != nil, "Replay from legacy peer did not fail the RPC", t)
+	assertTrue(res.Err.Err() == nil, "Legacy peer sent an error code", t)
+}
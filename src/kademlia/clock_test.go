@@ -0,0 +1,156 @@
+package kademlia
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Wait for n timers and tickers to be pending on c.
+func waitTimers(c *FakeClock, n int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if c.Timers() >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func Test_FakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	after := c.After(time.Minute)
+	tick := c.NewTicker(time.Second * 20)
+	assertIntEqual(2, c.Timers(), "Timers not pending", t)
+
+	c.Advance(time.Second * 30)
+	select {
+	case <-after:
+		t.Error("Timer fired early")
+	default:
+	}
+	now := <-tick.Chan()
+	assertTrue(now.Equal(start.Add(time.Second*20)), "Tick at the wrong time", t)
+
+	c.Advance(time.Second * 30)
+	now = <-after
+	assertTrue(now.Equal(start.Add(time.Minute)), "Timer fired at the wrong time", t)
+	assertTrue(c.Now().Equal(start.Add(time.Minute)), "Clock not advanced", t)
+	<-tick.Chan()
+	assertIntEqual(1, c.Timers(), "Fired timer still pending", t)
+
+	tick.Stop()
+	c.Advance(time.Minute)
+	select {
+	case <-tick.Chan():
+		t.Error("Stopped ticker fired")
+	default:
+	}
+	assertIntEqual(0, c.Timers(), "Stopped ticker still pending", t)
+}
+
+func Test_FakeClockExpiry(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	conf := DefaultConfig()
+	conf.Clock = clock
+	conf.HotThreshold = 0
+	conf.BanDuration = time.Hour
+	k := NewKademliaWithConfig("localhost:7982", conf)
+	ch, cancel := k.Events.Subscribe(64)
+	defer cancel()
+
+	peer := instance[0].SelfContact
+	k.DoPing(peer.Host, peer.Port)
+	seen, ok := k.AddrBook.LastSeen(peer.NodeID)
+	assertTrue(ok && seen.Equal(clock.Now()), "Last seen not read from the clock", t)
+	ev, ok := waitEvent(ch, EventContactAdded)
+	assertTrue(ok && ev.Time.Equal(clock.Now()), "Event time not read from the clock", t)
+
+	key := NewRandomID()
+	k.addDataFrom(Pair{key, []byte("cached")}, ValueOrigin{Kind: OriginCache}, clock.Now())
+	clock.Advance(conf.CacheTTL - time.Second)
+	_, err := k.getData(key)
+	assertTrue(err == nil, "Cached copy expired early", t)
+	clock.Advance(time.Second)
+	_, err = k.getData(key)
+	assertTrue(err != nil, "Cached copy outlived its TTL", t)
+	// ticks nobody was waiting for are dropped, so keep the sweeper ticking
+	expired := false
+	for i := 0; i < 10 && !expired; i++ {
+		clock.Advance(conf.CacheTTL / 4)
+		ev, ok := waitEvent(ch, EventValueExpired)
+		expired = ok && ev.Key.Equals(key)
+	}
+	assertTrue(expired, "Cached copy not swept", t)
+
+	banned := Contact{NodeID: NewRandomID()}
+	k.Reputation.Ban(banned.NodeID.AsString(), 0)
+	assertTrue(k.Reputation.Banned(banned), "Ban not applied", t)
+	clock.Advance(conf.BanDuration)
+	assertTrue(!k.Reputation.Banned(banned), "Ban outlived its duration", t)
+}
+
+// A lookup waits for peers in real time, a FakeClock nobody advances must not
+// leave it hanging on one that never answers.
+func Test_LookupTimeoutWithFakeClock(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:7998")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conf := DefaultConfig()
+	conf.Clock = NewFakeClock(time.Unix(1000, 0))
+	conf.HotThreshold = 0
+	conf.FindNodeTimeout = time.Millisecond * 100
+	conf.DialTimeout = time.Second * 5
+	k := NewKademliaWithConfig("localhost:7999", conf)
+	k.AddrBook.Update(Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7998, nil})
+
+	done := make(chan []Contact)
+	go func() { done <- k.iterativeFindNode(NewRandomID()) }()
+	select {
+	case found := <-done:
+		assertIntEqual(0, len(found), "Silent contact answered", t)
+	case <-time.After(time.Second * 3):
+		t.Error("Lookup waited on the fake clock")
+	}
+}
+
+/*
+ * Shares are refreshed into the next epoch's locations, so the data can
+ * still be recovered once the epoch it was vanished in is over.
+ */
+func Test_VanishRefreshAcrossEpochs(t *testing.T) {
+	conf := DefaultConfig()
+	// a minute into an epoch
+	clock := NewFakeClock(time.Unix(1000*int64(conf.EpochRange/time.Second)+60, 0))
+	conf.Clock = clock
+	conf.HotThreshold = 0
+	k := NewKademliaWithConfig("localhost:7983", conf)
+	k.Bootstrap([]string{"localhost:" + strconv.Itoa(int(instance[0].SelfContact.Port))})
+	ch, cancel := k.Events.Subscribe(64)
+	defer cancel()
+
+	data := []byte("refreshed")
+	key := GenerateRandomCryptoKey()
+	vdo := VanashingDataObject{GenerateRandomAccessKey(), encrypt(key, data), 10, 5, 16}
+	epoch := currentEpoch(clock, conf.EpochRange)
+	distributeShares(*k, vdo.NumberKeys, vdo.Threshold, key, vdo.AccessKey)
+	pending := clock.Timers()
+	go Refresh(*k, vdo)
+	assertTrue(waitTimers(clock, pending+1), "Refresh not waiting", t)
+
+	clock.Advance(conf.VanishRefresh)
+	assertTrue(currentEpoch(clock, conf.EpochRange) == epoch+1, "Epoch did not roll over", t)
+	ev, ok := waitEvent(ch, EventVdoRefreshed)
+	for deadline := time.Now().Add(time.Second * 10); !ok && time.Now().Before(deadline); {
+		ev, ok = waitEvent(ch, EventVdoRefreshed)
+	}
+	assertTrue(ok, "Shares not refreshed", t)
+	assertTrue(ev.Err == nil, "Refresh lost the shares", t)
+
+	clock.Advance(conf.EpochRange)
+	assertStringEqual(string(data), string(UnvanishData(*k, vdo)), "Data lost after rollover", t)
+}
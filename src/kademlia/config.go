@@ -0,0 +1,311 @@
+package kademlia
+
+// Contains the protocol parameters and timeouts of a node. DefaultConfig
+// matches the spec values; small test clusters usually want a lower K and
+// shorter timeouts.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+type Config struct {
+	Alpha             int           // lookup concurrency
+	K                 int           // bucket size and replication factor
+	FindNodeTimeout   time.Duration // per-contact timeout in iterativeFindNode
+	FindValueTimeout  time.Duration // per-contact timeout in iterativeFindValue
+	DialTimeout       time.Duration // connect timeout for each address of a contact
+	EpochRange        time.Duration // lifetime of one set of Vanish share locations
+	VanishRefresh     time.Duration // interval between Vanish share refreshes
+	EnvelopeWindow    time.Duration // accepted clock skew and replay window
+	BootstrapAttempts int           // pings per seed before giving up
+	BootstrapBackoff  time.Duration // wait before the second ping, doubled after
+	UDP               bool          // send PING, STORE, FIND_NODE and FIND_VALUE over UDP
+	UDPTimeout        time.Duration // wait for a UDP reply before retransmitting
+	UDPRetries        int           // UDP transmissions before falling back to TCP
+	NodeID            ID            // fixed node ID, random if zero
+	ResponsibleOnly   bool          // refuse STOREs for keys we are not among the k closest to
+	CacheTTL          time.Duration // lifetime of cached copies of values
+	// most contacts per IP and per /24 or /48 subnet, 0 for no limit
+	BucketIPLimit     int
+	BucketSubnetLimit int
+	TableIPLimit      int
+	TableSubnetLimit  int
+	BanThreshold      int           // penalty points before a peer is banned, 0 to never ban
+	BanDuration       time.Duration // how long automatic bans last
+	Advertise         string        // comma-separated host:port list to advertise, the listen addresses if empty
+	HotThreshold      int           // reads per HotWindow that make a key hot, 0 to never replicate hot keys
+	HotWindow         time.Duration // interval over which reads are counted
+	HotReplicas       int           // most extra replicas of a hot key
+	HotTTL            time.Duration // lifetime of the extra replicas, refreshed while the key stays hot
+	Clock             Clock         // time source, the system clock if nil; not part of the JSON form
+	Logger            Logger        // where the node logs, nowhere if nil; not part of the JSON form
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Alpha:             alpha,
+		K:                 k,
+		FindNodeTimeout:   time.Millisecond * 1000,
+		FindValueTimeout:  time.Millisecond * 300,
+		DialTimeout:       dialTimeout,
+		EpochRange:        time.Second * time.Duration(EPOCH_RANGE),
+		VanishRefresh:     time.Hour * 8,
+		EnvelopeWindow:    EnvelopeWindow,
+		BootstrapAttempts: bootstrapAttempts,
+		BootstrapBackoff:  bootstrapBackoff,
+		UDPTimeout:        time.Millisecond * 200,
+		UDPRetries:        3,
+		CacheTTL:          time.Minute * 10,
+		BanThreshold:      banThreshold,
+		BanDuration:       banDuration,
+		HotThreshold:      hotThreshold,
+		HotWindow:         hotWindow,
+		HotReplicas:       k,
+		HotTTL:            2 * hotWindow,
+	}
+}
+
+func (c Config) Validate() error {
+	switch {
+	case c.Alpha < 1:
+		return errors.New("alpha must be at least 1")
+	case c.K < 1:
+		return errors.New("k must be at least 1")
+	case c.FindNodeTimeout <= 0 || c.FindValueTimeout <= 0:
+		return errors.New("lookup timeouts must be positive")
+	case c.DialTimeout <= 0:
+		return errors.New("dial timeout must be positive")
+	case c.EpochRange < time.Second:
+		return errors.New("epoch range must be at least one second")
+	case c.VanishRefresh <= 0:
+		return errors.New("vanish refresh interval must be positive")
+	case c.EnvelopeWindow <= 0:
+		return errors.New("envelope window must be positive")
+	case c.BootstrapAttempts < 1:
+		return errors.New("bootstrap attempts must be at least 1")
+	case c.UDPTimeout <= 0:
+		return errors.New("UDP timeout must be positive")
+	case c.UDPRetries < 1:
+		return errors.New("UDP retries must be at least 1")
+	case c.CacheTTL <= 0:
+		return errors.New("cache TTL must be positive")
+	case c.BucketIPLimit < 0 || c.BucketSubnetLimit < 0 || c.TableIPLimit < 0 || c.TableSubnetLimit < 0:
+		return errors.New("diversity limits must not be negative")
+	case c.BanThreshold < 0:
+		return errors.New("ban threshold must not be negative")
+	case c.BanThreshold > 0 && c.BanDuration <= 0:
+		return errors.New("ban duration must be positive")
+	case c.HotThreshold < 0 || c.HotReplicas < 0:
+		return errors.New("hot key threshold and replicas must not be negative")
+	case c.HotWindow <= 0 || c.HotTTL <= 0:
+		return errors.New("hot key window and TTL must be positive")
+	}
+	for _, each := range splitAddressList(c.Advertise) {
+		if _, port, err := net.SplitHostPort(each); err != nil || port == "0" {
+			return errors.New("advertised address " + each + " is not a host:port")
+		}
+	}
+	return nil
+}
+
+// Load a JSON config file. Fields missing from the file keep their default
+// values. Durations are written as strings such as "300ms" or "8h".
+func LoadConfig(path string) (Config, error) {
+	conf := DefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return conf, err
+	}
+	return conf, conf.Validate()
+}
+
+// Register a command-line flag for every field, defaulting to the current
+// values of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Alpha, "alpha", c.Alpha, "lookup concurrency")
+	fs.IntVar(&c.K, "k", c.K, "bucket size and replication factor")
+	fs.DurationVar(&c.FindNodeTimeout, "find-node-timeout", c.FindNodeTimeout, "per-contact iterativeFindNode timeout")
+	fs.DurationVar(&c.FindValueTimeout, "find-value-timeout", c.FindValueTimeout, "per-contact iterativeFindValue timeout")
+	fs.DurationVar(&c.DialTimeout, "dial-timeout", c.DialTimeout, "connect timeout for each address of a contact")
+	fs.DurationVar(&c.EpochRange, "epoch-range", c.EpochRange, "lifetime of Vanish share locations")
+	fs.DurationVar(&c.VanishRefresh, "vanish-refresh", c.VanishRefresh, "interval between Vanish share refreshes")
+	fs.DurationVar(&c.EnvelopeWindow, "envelope-window", c.EnvelopeWindow, "accepted clock skew and replay window")
+	fs.IntVar(&c.BootstrapAttempts, "bootstrap-attempts", c.BootstrapAttempts, "pings per seed")
+	fs.DurationVar(&c.BootstrapBackoff, "bootstrap-backoff", c.BootstrapBackoff, "initial wait between seed pings")
+	fs.BoolVar(&c.UDP, "udp", c.UDP, "send RPCs over UDP, falling back to TCP")
+	fs.DurationVar(&c.UDPTimeout, "udp-timeout", c.UDPTimeout, "UDP retransmission timeout")
+	fs.IntVar(&c.UDPRetries, "udp-retries", c.UDPRetries, "UDP transmissions before falling back to TCP")
+	fs.Var((*idFlag)(&c.NodeID), "id", "fixed node ID as 40 hex digits, random if not set")
+	fs.BoolVar(&c.ResponsibleOnly, "responsible-only", c.ResponsibleOnly, "only accept STOREs for keys this node is among the k closest to")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "lifetime of cached copies of values")
+	fs.IntVar(&c.BucketIPLimit, "bucket-ip-limit", c.BucketIPLimit, "most contacts per IP in a bucket, 0 for no limit")
+	fs.IntVar(&c.BucketSubnetLimit, "bucket-subnet-limit", c.BucketSubnetLimit, "most contacts per /24 or /48 in a bucket, 0 for no limit")
+	fs.IntVar(&c.TableIPLimit, "table-ip-limit", c.TableIPLimit, "most contacts per IP in the routing table, 0 for no limit")
+	fs.IntVar(&c.TableSubnetLimit, "table-subnet-limit", c.TableSubnetLimit, "most contacts per /24 or /48 in the routing table, 0 for no limit")
+	fs.IntVar(&c.BanThreshold, "ban-threshold", c.BanThreshold, "penalty points before a peer is banned, 0 to never ban")
+	fs.DurationVar(&c.BanDuration, "ban-duration", c.BanDuration, "how long automatic bans last")
+	fs.StringVar(&c.Advertise, "advertise", c.Advertise, "comma-separated host:port list to advertise instead of the listen addresses")
+	fs.IntVar(&c.HotThreshold, "hot-threshold", c.HotThreshold, "reads per hot-window that make a key hot, 0 to never replicate hot keys")
+	fs.DurationVar(&c.HotWindow, "hot-window", c.HotWindow, "interval over which key reads are counted")
+	fs.IntVar(&c.HotReplicas, "hot-replicas", c.HotReplicas, "most extra replicas of a hot key")
+	fs.DurationVar(&c.HotTTL, "hot-ttl", c.HotTTL, "lifetime of the extra replicas of a hot key")
+}
+
+// A flag.Value for an ID, empty while the ID is zero.
+type idFlag ID
+
+func (f *idFlag) String() string {
+	if f == nil || ID(*f) == (ID{}) {
+		return ""
+	}
+	return ID(*f).AsString()
+}
+
+func (f *idFlag) Set(s string) error {
+	id, err := parseNodeID(s)
+	if err != nil {
+		return err
+	}
+	*f = idFlag(id)
+	return nil
+}
+
+func parseNodeID(s string) (ID, error) {
+	if len(s) != 2*IDBytes {
+		return ID{}, errors.New("node ID must be 40 hex digits")
+	}
+	return IDFromString(s)
+}
+
+type configJSON struct {
+	Alpha             int    `json:"alpha"`
+	K                 int    `json:"k"`
+	FindNodeTimeout   string `json:"find_node_timeout"`
+	FindValueTimeout  string `json:"find_value_timeout"`
+	DialTimeout       string `json:"dial_timeout"`
+	EpochRange        string `json:"epoch_range"`
+	VanishRefresh     string `json:"vanish_refresh"`
+	EnvelopeWindow    string `json:"envelope_window"`
+	BootstrapAttempts int    `json:"bootstrap_attempts"`
+	BootstrapBackoff  string `json:"bootstrap_backoff"`
+	UDP               bool   `json:"udp"`
+	UDPTimeout        string `json:"udp_timeout"`
+	UDPRetries        int    `json:"udp_retries"`
+	NodeID            string `json:"node_id,omitempty"`
+	ResponsibleOnly   bool   `json:"responsible_only"`
+	CacheTTL          string `json:"cache_ttl"`
+	BucketIPLimit     int    `json:"bucket_ip_limit"`
+	BucketSubnetLimit int    `json:"bucket_subnet_limit"`
+	TableIPLimit      int    `json:"table_ip_limit"`
+	TableSubnetLimit  int    `json:"table_subnet_limit"`
+	BanThreshold      int    `json:"ban_threshold"`
+	BanDuration       string `json:"ban_duration"`
+	Advertise         string `json:"advertise,omitempty"`
+	HotThreshold      int    `json:"hot_threshold"`
+	HotWindow         string `json:"hot_window"`
+	HotReplicas       int    `json:"hot_replicas"`
+	HotTTL            string `json:"hot_ttl"`
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.toJSON())
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	// start from the current values so missing fields are kept
+	j := c.toJSON()
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	durations := []struct {
+		s string
+		d *time.Duration
+	}{
+		{j.FindNodeTimeout, &c.FindNodeTimeout},
+		{j.FindValueTimeout, &c.FindValueTimeout},
+		{j.DialTimeout, &c.DialTimeout},
+		{j.EpochRange, &c.EpochRange},
+		{j.VanishRefresh, &c.VanishRefresh},
+		{j.EnvelopeWindow, &c.EnvelopeWindow},
+		{j.BootstrapBackoff, &c.BootstrapBackoff},
+		{j.UDPTimeout, &c.UDPTimeout},
+		{j.CacheTTL, &c.CacheTTL},
+		{j.BanDuration, &c.BanDuration},
+		{j.HotWindow, &c.HotWindow},
+		{j.HotTTL, &c.HotTTL},
+	}
+	for _, each := range durations {
+		d, err := time.ParseDuration(each.s)
+		if err != nil {
+			return err
+		}
+		*each.d = d
+	}
+	c.Alpha = j.Alpha
+	c.K = j.K
+	c.BootstrapAttempts = j.BootstrapAttempts
+	c.UDP = j.UDP
+	c.UDPRetries = j.UDPRetries
+	c.ResponsibleOnly = j.ResponsibleOnly
+	c.BucketIPLimit = j.BucketIPLimit
+	c.BucketSubnetLimit = j.BucketSubnetLimit
+	c.TableIPLimit = j.TableIPLimit
+	c.TableSubnetLimit = j.TableSubnetLimit
+	c.BanThreshold = j.BanThreshold
+	c.Advertise = j.Advertise
+	c.HotThreshold = j.HotThreshold
+	c.HotReplicas = j.HotReplicas
+	c.NodeID = ID{}
+	if j.NodeID != "" {
+		id, err := parseNodeID(j.NodeID)
+		if err != nil {
+			return err
+		}
+		c.NodeID = id
+	}
+	return nil
+}
+
+func (c Config) toJSON() configJSON {
+	return configJSON{
+		Alpha:             c.Alpha,
+		K:                 c.K,
+		FindNodeTimeout:   c.FindNodeTimeout.String(),
+		FindValueTimeout:  c.FindValueTimeout.String(),
+		DialTimeout:       c.DialTimeout.String(),
+		EpochRange:        c.EpochRange.String(),
+		VanishRefresh:     c.VanishRefresh.String(),
+		EnvelopeWindow:    c.EnvelopeWindow.String(),
+		BootstrapAttempts: c.BootstrapAttempts,
+		BootstrapBackoff:  c.BootstrapBackoff.String(),
+		UDP:               c.UDP,
+		UDPTimeout:        c.UDPTimeout.String(),
+		UDPRetries:        c.UDPRetries,
+		NodeID:            (*idFlag)(&c.NodeID).String(),
+		ResponsibleOnly:   c.ResponsibleOnly,
+		CacheTTL:          c.CacheTTL.String(),
+		BucketIPLimit:     c.BucketIPLimit,
+		BucketSubnetLimit: c.BucketSubnetLimit,
+		TableIPLimit:      c.TableIPLimit,
+		TableSubnetLimit:  c.TableSubnetLimit,
+		BanThreshold:      c.BanThreshold,
+		BanDuration:       c.BanDuration.String(),
+		Advertise:         c.Advertise,
+		HotThreshold:      c.HotThreshold,
+		HotWindow:         c.HotWindow.String(),
+		HotReplicas:       c.HotReplicas,
+		HotTTL:            c.HotTTL.String(),
+	}
+}
+
+func (c Config) diversityLimits() DiversityLimits {
+	return DiversityLimits{c.BucketIPLimit, c.BucketSubnetLimit, c.TableIPLimit, c.TableSubnetLimit}
+}
@@ -0,0 +1,87 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "kademlia-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"k": 4, "find_node_timeout": "200ms"}`)
+	f.Close()
+
+	conf, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(4, conf.K, "k not loaded", t)
+	assertTrue(conf.FindNodeTimeout == time.Millisecond*200, "Timeout not loaded", t)
+	assertIntEqual(alpha, conf.Alpha, "Missing field lost its default", t)
+	assertTrue(conf.VanishRefresh == time.Hour*8, "Missing duration lost its default", t)
+}
+
+func Test_ConfigJSONRoundTrip(t *testing.T) {
+	conf := DefaultConfig()
+	conf.K = 4
+	conf.FindValueTimeout = time.Millisecond * 50
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Config
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(conf == decoded, "Config changed after JSON round trip", t)
+}
+
+func Test_ConfigValidate(t *testing.T) {
+	conf := DefaultConfig()
+	assertTrue(conf.Validate() == nil, "Default config rejected", t)
+	conf.K = 0
+	assertTrue(conf.Validate() != nil, "k=0 accepted", t)
+
+	conf = DefaultConfig()
+	conf.BanDuration = 0
+	assertTrue(conf.Validate() != nil, "Bans without a duration accepted", t)
+	conf.BanThreshold = 0
+	assertTrue(conf.Validate() == nil, "Ban duration required with bans disabled", t)
+}
+
+func Test_SmallK(t *testing.T) {
+	conf := DefaultConfig()
+	conf.K = 4
+	conf.FindNodeTimeout = time.Millisecond * 100
+	node := NewKademliaWithConfig("localhost:7965", conf)
+	node.Bootstrap([]string{"localhost:" + strconv.Itoa(int(instance[0].SelfContact.Port))})
+	assertTrue(len(node.AddrBook.Contacts()) > 4, "Too few contacts to tell k apart", t)
+	assertIntEqual(4, len(node.AddrBook.Find(NewRandomID())), "Find does not return k contacts", t)
+	for i, bucket := range node.AddrBook.Buckets() {
+		assertTrue(len(bucket) <= 4, "Bucket "+strconv.Itoa(i)+" holds more than k contacts", t)
+	}
+	assertIntEqual(4, len(node.iterativeFindNode(NewRandomID())), "Lookup does not return k contacts", t)
+}
+
+func Test_ConfigNodeID(t *testing.T) {
+	conf := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	conf.RegisterFlags(fs)
+	id := NewRandomID()
+	assertTrue(fs.Parse([]string{"-id", id.AsString()}) == nil, "Valid -id rejected", t)
+	assertTrue(conf.NodeID.Equals(id), "-id not applied", t)
+	assertTrue(fs.Parse([]string{"-id", "abc"}) != nil, "Short -id accepted", t)
+
+	data, _ := json.Marshal(conf)
+	var decoded Config
+	assertTrue(json.Unmarshal(data, &decoded) == nil, "Config with node_id not decoded", t)
+	assertTrue(decoded.NodeID.Equals(id), "node_id lost in JSON round trip", t)
+}
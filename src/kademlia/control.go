@@ -0,0 +1,122 @@
+package kademlia
+
+// Contains the local control socket used by daemon mode. A client sends one
+// CLI command per line; each reply is the command's output followed by a line
+// holding a single ".". Reply lines starting with "." get another "."
+// prepended, the way SMTP does it, so any output can be framed.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Reply sent when a client asks the daemon to quit.
+const ControlQuitReply = "OK: quitting"
+
+// Listen on a Unix domain socket at path. A socket file left behind by a dead
+// daemon is removed; one with a live daemon behind it is an error.
+func ListenControl(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("a daemon is already listening on " + path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve commands from every client of l concurrently until a client sends
+// "quit", then close l and return. Each line is passed to execute, which
+// returns "quit" for the quit command the way the CLI does.
+func ServeControl(l net.Listener, execute func(line string) string) {
+	quit := make(chan bool)
+	var once sync.Once
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConn(conn, execute, func() { once.Do(func() { close(quit) }) })
+		}
+	}()
+	<-quit
+	l.Close()
+}
+
+func serveControlConn(conn net.Conn, execute func(string) string, quit func()) {
+	defer conn.Close()
+	in := bufio.NewScanner(conn)
+	out := bufio.NewWriter(conn)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		resp := execute(line)
+		if resp == "quit" {
+			writeControlReply(out, ControlQuitReply)
+			out.Flush()
+			quit()
+			return
+		}
+		writeControlReply(out, resp)
+		if out.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeControlReply(w *bufio.Writer, resp string) {
+	resp = strings.TrimRight(resp, "\n")
+	if resp != "" {
+		for _, line := range strings.Split(resp, "\n") {
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+			w.WriteString(line + "\n")
+		}
+	}
+	w.WriteString(".\n")
+}
+
+type ControlClient struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func DialControl(path string) (*ControlClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlClient{conn, bufio.NewReader(conn)}, nil
+}
+
+// Send one command and return its reply.
+func (c *ControlClient) Execute(line string) (string, error) {
+	if _, err := c.conn.Write([]byte(strings.TrimSpace(line) + "\n")); err != nil {
+		return "", err
+	}
+	lines := make([]string, 0)
+	for {
+		reply, err := c.in.ReadString('\n')
+		if err != nil {
+			return strings.Join(lines, "\n"), err
+		}
+		reply = strings.TrimSuffix(reply, "\n")
+		if reply == "." {
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, strings.TrimPrefix(reply, "."))
+	}
+}
+
+func (c *ControlClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,58 @@
+package kademlia
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control")
+	l, err := ListenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(line string) string {
+		switch line {
+		case "quit":
+			return "quit"
+		case "dots":
+			return "OK:\n.hidden\n.\nend\n"
+		}
+		return "echo " + line
+	}
+	done := make(chan bool)
+	go func() {
+		ServeControl(l, execute)
+		done <- true
+	}()
+
+	_, err = ListenControl(path)
+	assertTrue(err != nil, "Second daemon allowed on a live socket", t)
+
+	c1, err := DialControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := DialControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	resp, _ := c1.Execute("whoami")
+	assertStringEqual("echo whoami", resp, "Wrong reply to first client", t)
+	resp, _ = c2.Execute("ping")
+	assertStringEqual("echo ping", resp, "Wrong reply to second client", t)
+	resp, _ = c1.Execute("dots")
+	assertStringEqual("OK:\n.hidden\n.\nend", resp, "Multi-line reply not framed", t)
+
+	resp, _ = c2.Execute("quit")
+	assertStringEqual(ControlQuitReply, resp, "Wrong reply to quit", t)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Daemon did not stop on quit")
+	}
+}
@@ -0,0 +1,68 @@
+package kademlia
+
+// Contains the IP diversity limits of the routing table. Without them one
+// host, or one subnet, running many nodes can fill a bucket or the whole
+// table and cut us off from the rest of the network. Contacts over a limit
+// are kept in the bucket's replacement cache instead.
+
+import (
+	"net"
+)
+
+// Most contacts sharing an IP address, or a /24 (IPv4) or /48 (IPv6) subnet,
+// allowed in one bucket and in the whole table. Zero means no limit.
+type DiversityLimits struct {
+	BucketIP     int
+	BucketSubnet int
+	TableIP      int
+	TableSubnet  int
+}
+
+// The subnet an address counts against, "" if it has none.
+func subnetOf(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 8*net.IPv6len)).String()
+}
+
+func underLimit(limit, n int) bool {
+	return limit == 0 || n < limit
+}
+
+// Whether c can join bucket index of t, holding entries, without going over a
+// limit.
+func (l DiversityLimits) allow(t *routingTable, index int, entries []tableEntry, c Contact) bool {
+	if l == (DiversityLimits{}) || c.Host == nil {
+		return true
+	}
+	subnet := subnetOf(c.Host)
+	var bucketIP, bucketSubnet, tableIP, tableSubnet int
+	for i := range t.buckets {
+		bucket := entries
+		if i != index {
+			bucket = t.bucket(i).entries
+		}
+		for _, each := range bucket {
+			sameIP := each.contact.Host.Equal(c.Host)
+			sameSubnet := subnetOf(each.contact.Host) == subnet
+			if sameIP {
+				tableIP++
+			}
+			if sameSubnet {
+				tableSubnet++
+			}
+			if i == index && sameIP {
+				bucketIP++
+			}
+			if i == index && sameSubnet {
+				bucketSubnet++
+			}
+		}
+	}
+	return underLimit(l.BucketIP, bucketIP) && underLimit(l.BucketSubnet, bucketSubnet) &&
+		underLimit(l.TableIP, tableIP) && underLimit(l.TableSubnet, tableSubnet)
+}
@@ -0,0 +1,177 @@
+package kademlia
+
+// Contains the envelope checks shared by every RPC: protocol version,
+// timestamp freshness, replay detection and MsgID echo matching. Violations
+// are recorded against the offending peer, and requests from banned peers are
+// refused.
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Version of the envelope carried by our messages. Peers running the
+// reference implementation send no envelope at all, which decodes as
+// version 0 and is accepted without timestamp checks.
+const ProtocolVersion = 1
+
+// Requests older or newer than this are rejected, and MsgIDs are remembered
+// for the same duration to drop replays. This is the default for
+// Config.EnvelopeWindow.
+const EnvelopeWindow = time.Minute * 2
+
+type Envelope struct {
+	Version   uint8
+	Timestamp int64
+}
+
+func NewEnvelope() Envelope {
+	return Envelope{ProtocolVersion, time.Now().Unix()}
+}
+
+type EnvelopeError struct {
+	kind Violation
+	msg  string
+}
+
+func (e *EnvelopeError) Error() string {
+	return e.msg
+}
+
+// ======================= Violations ===================
+type Violation int
+
+const (
+	BadMsgID Violation = iota
+	BadVersion
+	BadTimestamp
+	ReplayedRequest
+	Timeout       // no answer to one of our requests
+	InvalidRecord // malformed contact
+)
+
+func (v Violation) String() string {
+	switch v {
+	case BadMsgID:
+		return "bad MsgID"
+	case BadVersion:
+		return "bad version"
+	case BadTimestamp:
+		return "bad timestamp"
+	case ReplayedRequest:
+		return "replayed request"
+	case Timeout:
+		return "timeout"
+	case InvalidRecord:
+		return "invalid record"
+	}
+	return "unknown"
+}
+
+// ======================= Replay cache ===================
+// ReplayCache remembers recently seen MsgIDs for the envelope window.
+type ReplayCache struct {
+	window  time.Duration
+	seen    map[ID]time.Time
+	checkCh chan ID
+	resCh   chan bool
+}
+
+func NewReplayCache(window time.Duration) *ReplayCache {
+	r := new(ReplayCache)
+	r.window = window
+	r.seen = make(map[ID]time.Time)
+	r.checkCh = make(chan ID)
+	r.resCh = make(chan bool)
+	go r.worker()
+	return r
+}
+
+// Mark a MsgID as seen. Returns true if it had already been seen inside the
+// window.
+func (r *ReplayCache) Seen(msgId ID) bool {
+	r.checkCh <- msgId
+	return <-r.resCh
+}
+
+func (r *ReplayCache) worker() {
+	tick := time.NewTicker(r.window)
+	for {
+		select {
+		case msgId := <-r.checkCh:
+			now := time.Now()
+			if at, ok := r.seen[msgId]; ok && now.Sub(at) < r.window {
+				r.resCh <- true
+			} else {
+				r.seen[msgId] = now
+				r.resCh <- false
+			}
+		case now := <-tick.C:
+			for msgId, at := range r.seen {
+				if now.Sub(at) >= r.window {
+					delete(r.seen, msgId)
+				}
+			}
+		}
+	}
+}
+
+// ======================= Checks ===================
+// Validate an incoming request from source, nil if unknown. Violations only
+// count against source: the sender is whoever the request claims it is.
+func (k *Kademlia) checkRequest(sender Contact, source net.IP, msgId ID, env Envelope) error {
+	if k.Reputation.Banned(Contact{NodeID: sender.NodeID, Host: source}) {
+		return &ProtocolError{CodeBanned, "sender is banned"}
+	}
+	err := validateEnvelope(env, time.Now(), k.Config.EnvelopeWindow)
+	if err == nil && k.replay.Seen(msgId) {
+		err = &EnvelopeError{ReplayedRequest, "replayed request " + msgId.AsString()}
+	}
+	if err != nil {
+		kind := err.(*EnvelopeError).kind
+		if k.Reputation.PenalizeSource(source, kind) {
+			k.Logger.Warn("address banned", F("host", source), F("violation", kind))
+		}
+		return err
+	}
+	return nil
+}
+
+// Validate a response to one of our requests. Any violation is recorded
+// against the contact we called, a valid response counts in its favour.
+func (k *Kademlia) checkResponse(contact Contact, reqId, resId ID) error {
+	err := validateResponse(reqId, resId)
+	if err != nil {
+		k.recordViolation(contact, err.(*EnvelopeError).kind)
+		return err
+	}
+	k.Reputation.Reward(contact)
+	return nil
+}
+
+// Responses from newer peers are accepted, PING negotiates down to our version.
+func validateResponse(reqId, resId ID) error {
+	if resId != reqId {
+		return &EnvelopeError{BadMsgID, fmt.Sprintf(
+			"MsgID mismatch, sent %s got %s", reqId.AsString(), resId.AsString())}
+	}
+	return nil
+}
+
+func validateEnvelope(env Envelope, now time.Time, window time.Duration) error {
+	if env.Version > ProtocolVersion {
+		return &EnvelopeError{BadVersion, fmt.Sprintf(
+			"unsupported protocol version %d", env.Version)}
+	}
+	if env.Version == 0 {
+		// legacy peer, no timestamp to check
+		return nil
+	}
+	skew := now.Sub(time.Unix(env.Timestamp, 0))
+	if skew > window || skew < -window {
+		return &EnvelopeError{BadTimestamp, fmt.Sprintf(
+			"timestamp %d outside window", env.Timestamp)}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_EnvelopeTimestamp(t *testing.T) {
+	now := time.Now()
+	fresh := Envelope{ProtocolVersion, now.Unix()}
+	stale := Envelope{ProtocolVersion, now.Add(-2 * EnvelopeWindow).Unix()}
+	future := Envelope{ProtocolVersion, now.Add(2 * EnvelopeWindow).Unix()}
+	assertTrue(validateEnvelope(fresh, now, EnvelopeWindow) == nil, "Fresh envelope rejected", t)
+	assertTrue(validateEnvelope(stale, now, EnvelopeWindow) != nil, "Stale envelope accepted", t)
+	assertTrue(validateEnvelope(future, now, EnvelopeWindow) != nil, "Future envelope accepted", t)
+	assertTrue(validateEnvelope(Envelope{}, now, EnvelopeWindow) == nil, "Legacy envelope rejected", t)
+	assertTrue(
+		validateEnvelope(Envelope{ProtocolVersion + 1, now.Unix()}, now, EnvelopeWindow) != nil,
+		"Unknown version accepted",
+		t)
+}
+
+func Test_EnvelopeReplay(t *testing.T) {
+	k := instance[0]
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil}
+	source := net.IPv4(10, 0, 0, 77)
+	msgId := NewRandomID()
+	err := k.checkRequest(sender, source, msgId, NewEnvelope())
+	assertTrue(err == nil, "First request rejected", t)
+	err = k.checkRequest(sender, source, msgId, NewEnvelope())
+	assertTrue(err != nil, "Replayed request accepted", t)
+	assertIntEqual(
+		1,
+		k.Reputation.Violations(source.String())[ReplayedRequest],
+		"Replay not recorded as misbehaviour",
+		t)
+}
+
+func Test_EnvelopeMsgIDMismatch(t *testing.T) {
+	k := instance[0]
+	peer := instance[1].SelfContact
+	err := k.checkResponse(peer, NewRandomID(), NewRandomID())
+	assertTrue(err != nil, "Mismatched MsgID accepted", t)
+	assertTrue(
+		k.Reputation.Violations(peer.NodeID.AsString())[BadMsgID] > 0,
+		"Mismatched MsgID not recorded as misbehaviour",
+		t)
+}
@@ -0,0 +1,112 @@
+package kademlia
+
+// Contains the error codes carried in RPC results. A refused request still
+// gets a result with its MsgID and envelope, with Err set to the reason; the
+// client side turns that into a *ProtocolError which callers can match against
+// the Err* values below with errors.Is.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type ErrorCode uint8
+
+const (
+	CodeOK ErrorCode = iota
+	CodeInternal
+	CodeBadEnvelope
+	CodeNotResponsible
+	CodeBanned
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeOK:
+		return "ok"
+	case CodeInternal:
+		return "internal error"
+	case CodeBadEnvelope:
+		return "bad envelope"
+	case CodeNotResponsible:
+		return "not responsible"
+	case CodeBanned:
+		return "banned"
+	}
+	return fmt.Sprintf("error code %d", uint8(c))
+}
+
+// The wire form of an error, the zero value means success.
+type RPCError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Convert an error raised while handling a request into its wire form.
+func rpcErrorFrom(err error) RPCError {
+	var envErr *EnvelopeError
+	var protoErr *ProtocolError
+	switch {
+	case err == nil:
+		return RPCError{}
+	case errors.As(err, &envErr):
+		return RPCError{CodeBadEnvelope, envErr.Error()}
+	case errors.As(err, &protoErr):
+		return RPCError{protoErr.Code, protoErr.Message}
+	}
+	return RPCError{CodeInternal, err.Error()}
+}
+
+// Return the typed error for e, or nil if e reports success.
+func (e RPCError) Err() error {
+	if e.Code == CodeOK {
+		return nil
+	}
+	return &ProtocolError{e.Code, e.Message}
+}
+
+// An error reported by the remote node. Codes this node does not know are
+// kept as they are.
+type ProtocolError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return e.Message
+}
+
+// Match any *ProtocolError with the same code, so that
+// errors.Is(err, ErrNotResponsible) ignores the message.
+func (e *ProtocolError) Is(target error) bool {
+	t, ok := target.(*ProtocolError)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrInternal       = &ProtocolError{Code: CodeInternal}
+	ErrBadEnvelope    = &ProtocolError{Code: CodeBadEnvelope}
+	ErrNotResponsible = &ProtocolError{Code: CodeNotResponsible}
+	ErrBanned         = &ProtocolError{Code: CodeBanned}
+)
+
+// The error a handler reported, either by failing the RPC or in its result.
+func handlerError(err error, res RPCError) error {
+	if err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// Turn one of the "ERR: ..." strings returned by the Do* functions back into
+// an error, nil for "OK: ..." strings.
+func responseError(response string) error {
+	if strings.HasPrefix(response, "OK:") {
+		return nil
+	}
+	return errors.New(strings.TrimSpace(strings.TrimPrefix(response, "ERR:")))
+}
@@ -0,0 +1,40 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_RPCErrorCodes(t *testing.T) {
+	assertTrue(RPCError{}.Err() == nil, "Zero RPCError is an error", t)
+	err := RPCError{CodeNotResponsible, "ask someone closer"}.Err()
+	assertTrue(errors.Is(err, ErrNotResponsible), "Code not matched by errors.Is", t)
+	assertFalse(errors.Is(err, ErrBanned), "Wrong code matched by errors.Is", t)
+	assertStringEqual("ask someone closer", err.Error(), "Message not kept", t)
+	assertStringEqual("banned", ErrBanned.Error(), "Code without message", t)
+
+	wire := rpcErrorFrom(&EnvelopeError{BadTimestamp, "too old"})
+	assertTrue(wire.Code == CodeBadEnvelope, "Envelope error not coded", t)
+	wire = rpcErrorFrom(errors.New("disk on fire"))
+	assertTrue(wire.Code == CodeInternal, "Unknown error not coded as internal", t)
+}
+
+/*
+ * A store with a stale envelope is refused in the result rather than failing
+ * the RPC, and the client sees a typed error.
+ */
+func Test_StoreRefused(t *testing.T) {
+	core := &KademliaCore{instance[1], nil}
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil}
+	stale := Envelope{ProtocolVersion, time.Now().Add(-2 * EnvelopeWindow).Unix()}
+	req := StoreRequest{sender, NewRandomID(), NewRandomID(), []byte("stale"), false, 0, stale}
+	var res StoreResult
+	err := core.Store(req, &res)
+	assertTrue(err == nil, "Refusal failed the RPC", t)
+	assertTrue(res.MsgID == req.MsgID, "Refusal has wrong MsgID", t)
+	assertTrue(errors.Is(res.Err.Err(), ErrBadEnvelope), "Refusal has wrong code", t)
+	_, err = instance[1].getData(req.Key)
+	assertTrue(err != nil, "Refused value was stored", t)
+}
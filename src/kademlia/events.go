@@ -0,0 +1,126 @@
+package kademlia
+
+// Contains the event hooks for applications embedding a node. Events are
+// emitted from inside the routing table goroutine, the local store and the RPC
+// handlers, so emitting never blocks: each subscriber has a buffered channel
+// and events that do not fit are dropped and counted.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EventContactAdded EventKind = iota
+	EventContactRemoved
+	EventValueStored
+	// A cached copy dropped once its TTL ran out.
+	EventValueExpired
+	EventVdoRefreshed
+	EventRPCReceived
+	EventLookupDone
+)
+
+func (e EventKind) String() string {
+	switch e {
+	case EventContactAdded:
+		return "contact added"
+	case EventContactRemoved:
+		return "contact removed"
+	case EventValueStored:
+		return "value stored"
+	case EventValueExpired:
+		return "value expired"
+	case EventVdoRefreshed:
+		return "vdo refreshed"
+	case EventRPCReceived:
+		return "rpc received"
+	case EventLookupDone:
+		return "lookup done"
+	}
+	return "unknown event"
+}
+
+// Fields not relevant to the kind are left zero.
+type Event struct {
+	Kind      EventKind
+	Time      time.Time
+	Contact   Contact // contact added or removed, sender of an RPC
+	Key       ID      // key stored or expired, target of a lookup
+	Size      int     // size of a stored value
+	RPC       string  // name of a received RPC or of a lookup
+	Hops      int     // rounds taken by a lookup
+	AccessKey int64   // access key of a refreshed VDO
+	Err       error   // a rejected RPC, or a VDO whose key could not be recovered
+}
+
+type Events struct {
+	Clock   Clock // when events happen
+	mu      sync.Mutex
+	subs    map[int]chan Event
+	next    int
+	dropped uint64
+}
+
+func NewEvents() *Events {
+	e := new(Events)
+	e.Clock = SystemClock
+	e.subs = make(map[int]chan Event)
+	return e
+}
+
+// Subscribe to every event. Up to buffer events are queued for a slow reader;
+// later ones are dropped. The returned function cancels the subscription and
+// closes the channel.
+func (e *Events) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	e.mu.Lock()
+	id := e.next
+	e.next++
+	e.subs[id] = ch
+	e.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subs, id)
+			close(ch)
+			e.mu.Unlock()
+		})
+	}
+}
+
+// Call fn for every event from a goroutine of its own, in order.
+func (e *Events) OnEvent(fn func(Event)) func() {
+	ch, cancel := e.Subscribe(256)
+	go func() {
+		for ev := range ch {
+			fn(ev)
+		}
+	}()
+	return cancel
+}
+
+// Number of events dropped because a subscriber was not keeping up.
+func (e *Events) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+func (e *Events) emit(ev Event) {
+	if e == nil {
+		return
+	}
+	ev.Time = e.Clock.Now()
+	e.mu.Lock()
+	for _, ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+			atomic.AddUint64(&e.dropped, 1)
+		}
+	}
+	e.mu.Unlock()
+}
@@ -0,0 +1,75 @@
+package kademlia
+
+import (
+	"testing"
+	"time"
+)
+
+// Read events until one of the given kind arrives or a second passes.
+func waitEvent(ch <-chan Event, kind EventKind) (Event, bool) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Kind == kind {
+				return ev, true
+			}
+		case <-timeout:
+			return Event{}, false
+		}
+	}
+}
+
+func Test_Events(t *testing.T) {
+	k := NewKademlia("localhost:7971")
+	ch, cancel := k.Events.Subscribe(64)
+	defer cancel()
+
+	instance[0].DoPingAddresses(k.SelfContact.Addresses())
+	ev, ok := waitEvent(ch, EventRPCReceived)
+	assertTrue(ok, "No RPC received event", t)
+	assertStringEqual("ping", ev.RPC, "Wrong RPC name", t)
+	ev, ok = waitEvent(ch, EventContactAdded)
+	assertTrue(ok, "No contact added event", t)
+	assertTrue(ev.Contact.NodeID.Equals(instance[0].NodeID), "Wrong contact added", t)
+
+	key := NewRandomID()
+	instance[0].DoStore(&k.SelfContact, key, []byte("event"))
+	ev, ok = waitEvent(ch, EventValueStored)
+	assertTrue(ok, "No value stored event", t)
+	assertTrue(ev.Key.Equals(key), "Wrong key stored", t)
+	assertIntEqual(5, ev.Size, "Wrong value size", t)
+
+	k.DoIterativeFindNode(NewRandomID())
+	ev, ok = waitEvent(ch, EventLookupDone)
+	assertTrue(ok, "No lookup done event", t)
+	assertStringEqual("find_node", ev.RPC, "Wrong lookup name", t)
+}
+
+/*
+ * A subscriber that never reads must not block the emitter, its events are
+ * dropped instead.
+ */
+func Test_EventsDoNotBlock(t *testing.T) {
+	events := NewEvents()
+	ch, cancel := events.Subscribe(1)
+	called := make(chan Event, 3)
+	stop := events.OnEvent(func(ev Event) { called <- ev })
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		events.emit(Event{Kind: EventValueStored})
+	}
+	assertIntEqual(2, int(events.Dropped()), "Full subscriber did not drop", t)
+	cancel()
+	<-ch
+	_, open := <-ch
+	assertFalse(open, "Cancelled subscription not closed", t)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			t.Fatal("Callback not called for every event")
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package kademlia
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+)
+
+/*
+ * Mount a node on a host service's own listener and mux, next to one of the
+ * host's handlers.
+ */
+func Test_MountOnHostMux(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:7970")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("healthy"))
+	})
+	k, err := NewKademliaWithListeners([]net.Listener{l}, DefaultConfig())
+	assertTrue(err == nil, "Could not build node on listener", t)
+	k.Mount(mux)
+	go http.Serve(l, mux)
+
+	assertContains(
+		instance[0].DoPing(net.IPv4(127, 0, 0, 1), 7970),
+		"OK: Ping "+k.NodeID.AsString(),
+		"Mounted node does not answer pings",
+		t)
+	resp, err := http.Get("http://localhost:7970/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assertStringEqual("healthy", string(body), "Host handler shadowed", t)
+}
+
+func Test_NoDefaultServeMux(t *testing.T) {
+	req := httptest.NewRequest("CONNECT", rpc.DefaultRPCPath+"7890", nil)
+	_, pattern := http.DefaultServeMux.Handler(req)
+	assertStringEqual("", pattern, "Node registered on DefaultServeMux", t)
+}
@@ -0,0 +1,203 @@
+package kademlia
+
+// Contains hot-key detection and adaptive replication. Every HotWindow the
+// node collects the read counts of the values it holds. A value read at least
+// HotThreshold times in a window becomes hot, and stays hot until its reads
+// fall below half that. While a key is hot, the node stores cached copies
+// with a short TTL on a ring of nodes just outside the k closest, k extra
+// copies for every HotThreshold reads up to HotReplicas, so lookups for it
+// stop before reaching the k closest. The copies are refreshed every window;
+// once the key cools down they are no longer refreshed and expire.
+//
+// Reads the copies serve count towards the key too, or it would cool down as
+// soon as its copies take the load off this node: every refresh reports how
+// often the copy it replaces was read.
+//
+// Only values held for good are replicated, so nodes holding a cached copy
+// do not spread it further.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for Config.HotThreshold and Config.HotWindow.
+const (
+	hotThreshold = 100
+	hotWindow    = time.Minute
+)
+
+type HotKey struct {
+	Key      ID
+	Reads    int64     // reads in the last window, here and at replicas
+	Since    time.Time // when the key became hot
+	Replicas []Contact // nodes holding an extra copy
+}
+
+type HotKeys struct {
+	mu   sync.Mutex
+	keys map[ID]*HotKey
+}
+
+func NewHotKeys() *HotKeys {
+	h := new(HotKeys)
+	h.keys = make(map[ID]*HotKey)
+	return h
+}
+
+// Return a copy of every hot key, most read first.
+func (h *HotKeys) List() []HotKey {
+	h.mu.Lock()
+	result := make([]HotKey, 0, len(h.keys))
+	for _, each := range h.keys {
+		hot := *each
+		hot.Replicas = append([]Contact{}, each.Replicas...)
+		result = append(result, hot)
+	}
+	h.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Reads != result[j].Reads {
+			return result[i].Reads > result[j].Reads
+		}
+		return result[i].Key.Less(result[j].Key)
+	})
+	return result
+}
+
+// Apply the read counts of one window and return the keys hot after it.
+// Keys no longer held are dropped.
+func (h *HotKeys) update(reads map[ID]int64, threshold int64, held func(ID) bool, now time.Time) []HotKey {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, n := range reads {
+		if _, ok := h.keys[key]; !ok && n >= threshold && held(key) {
+			h.keys[key] = &HotKey{Key: key, Since: now, Replicas: make([]Contact, 0)}
+		}
+	}
+	result := make([]HotKey, 0, len(h.keys))
+	for key, each := range h.keys {
+		each.Reads = reads[key]
+		if 2*each.Reads < threshold || !held(key) {
+			delete(h.keys, key)
+			continue
+		}
+		result = append(result, *each)
+	}
+	return result
+}
+
+func (h *HotKeys) setReplicas(key ID, replicas []Contact) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if each, ok := h.keys[key]; ok {
+		each.Replicas = replicas
+	}
+}
+
+// Replicate hot keys once per HotWindow.
+func (k *Kademlia) hotWorker() {
+	tick := k.Clock.NewTicker(k.Config.HotWindow)
+	for now := range tick.Chan() {
+		k.updateHotKeys(now)
+	}
+}
+
+// Collect the read counts of the last window, here and at the replicas,
+// update the hot keys and store or refresh their extra copies.
+func (k *Kademlia) updateHotKeys(now time.Time) {
+	held := func(key ID) bool {
+		_, info, ok := k.LocalData.Peek(key)
+		return ok && info.Origin.Kind != OriginCache
+	}
+	reads := k.LocalData.ReadCounts()
+	// refresh the current replicas first, their reads decide what stays hot
+	refreshed := make(map[ID]map[ID]bool)
+	for _, hot := range k.Hot.List() {
+		value, _, ok := k.LocalData.Peek(hot.Key)
+		if !ok {
+			continue
+		}
+		refreshed[hot.Key] = make(map[ID]bool)
+		for _, each := range hot.Replicas {
+			res, _, err := k.storeValue(&each, hot.Key, value, true, k.Config.HotTTL)
+			if err == nil {
+				reads[hot.Key] += res.Reads
+				refreshed[hot.Key][each.NodeID] = true
+			}
+		}
+	}
+	threshold := int64(k.Config.HotThreshold)
+	for _, hot := range k.Hot.update(reads, threshold, held, now) {
+		value, _, ok := k.LocalData.Peek(hot.Key)
+		if !ok {
+			continue
+		}
+		n := int(int64(k.Config.K) * hot.Reads / threshold)
+		if n > k.Config.HotReplicas {
+			n = k.Config.HotReplicas
+		}
+		replicas := make([]Contact, 0, n)
+		for _, each := range k.widerRing(hot.Key, n) {
+			if refreshed[hot.Key][each.NodeID] {
+				replicas = append(replicas, each)
+			} else if _, _, err := k.storeValue(&each, hot.Key, value, true, k.Config.HotTTL); err == nil {
+				replicas = append(replicas, each)
+			}
+		}
+		k.Hot.setReplicas(hot.Key, replicas)
+		k.Logger.Info("hot key replicated", F("key", hot.Key), F("reads", hot.Reads),
+			F("replicas", len(replicas)))
+	}
+}
+
+// Return up to n nodes closest to key after the k closest, gathered from the
+// routing tables of the k closest.
+func (k *Kademlia) widerRing(key ID, n int) []Contact {
+	if n <= 0 {
+		return []Contact{}
+	}
+	closest := k.iterativeFindNode(key)
+	seen := map[ID]bool{k.NodeID: true}
+	for _, each := range closest {
+		seen[each.NodeID] = true
+	}
+	ring := make([]Contact, 0)
+	for _, each := range closest {
+		nodes, err := k.FindNode(&each, key)
+		if err != nil {
+			continue
+		}
+		for _, c := range nodes {
+			if !seen[c.NodeID] {
+				seen[c.NodeID] = true
+				ring = append(ring, c)
+			}
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return key.Xor(ring[i].NodeID).Less(key.Xor(ring[j].NodeID))
+	})
+	if len(ring) > n {
+		ring = ring[:n]
+	}
+	return ring
+}
+
+// ======================= CLI ===================
+func (k *Kademlia) DoHotKeys() string {
+	hot := k.Hot.List()
+	lines := []string{fmt.Sprintf("OK: %d hot keys", len(hot))}
+	now := k.Clock.Now()
+	for _, each := range hot {
+		lines = append(lines, fmt.Sprintf("%s reads=%d replicas=%d hot-for=%s",
+			each.Key.AsString(), each.Reads, len(each.Replicas),
+			now.Sub(each.Since).Round(time.Second)))
+		for _, c := range each.Replicas {
+			lines = append(lines, "  "+c.NodeID.AsString()+" "+Address{c.Host, c.Port}.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
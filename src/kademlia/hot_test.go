@@ -0,0 +1,71 @@
+package kademlia
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_HotKeyReplication(t *testing.T) {
+	conf := DefaultConfig()
+	conf.HotThreshold = 10
+	conf.HotWindow = time.Hour
+	conf.HotTTL = time.Second * 30
+	k := NewKademliaWithConfig("localhost:7981", conf)
+	k.Bootstrap([]string{"localhost:" + strconv.Itoa(int(instance[0].SelfContact.Port))})
+	key := NewRandomID()
+	k.addData(Pair{key, []byte("hot")})
+	k.LocalData.ReadCounts()
+
+	read := func(n int) {
+		for i := 0; i < n; i++ {
+			value, _, err := instance[8].FindValue(&k.SelfContact, key)
+			assertTrue(err == nil && string(value) == "hot", "Value not read", t)
+		}
+	}
+	read(conf.HotThreshold)
+	k.updateHotKeys(time.Now())
+	hot := k.Hot.List()
+	assertIntEqual(1, len(hot), "Key not hot", t)
+	assertIntEqual(conf.HotThreshold, int(hot[0].Reads), "Reads not counted", t)
+	assertTrue(len(hot[0].Replicas) > 0, "Hot key not replicated", t)
+	assertTrue(len(hot[0].Replicas) <= conf.HotReplicas, "Too many replicas", t)
+	assertContains(k.DoHotKeys(), key.AsString(), "Hot key not listed", t)
+
+	replicated := 0
+	for _, each := range instance {
+		for _, replica := range hot[0].Replicas {
+			if each.NodeID != replica.NodeID {
+				continue
+			}
+			_, info, ok := each.LocalData.Peek(key)
+			if ok && info.Origin.Kind == OriginCache && info.Expires.Before(time.Now().Add(conf.HotTTL)) {
+				replicated++
+			}
+		}
+	}
+	assertTrue(replicated > 0, "No replica holds a short-lived copy", t)
+
+	// reads served by a replica keep the key hot
+	replica := hot[0].Replicas[0]
+	for i := 0; i < conf.HotThreshold; i++ {
+		value, _, err := instance[8].FindValue(&replica, key)
+		assertTrue(err == nil && string(value) == "hot", "Value not read from replica", t)
+	}
+	k.updateHotKeys(time.Now())
+	hot = k.Hot.List()
+	assertIntEqual(1, len(hot), "Key cooled while its replicas served it", t)
+	assertIntEqual(conf.HotThreshold, int(hot[0].Reads), "Replica reads not counted", t)
+
+	// half the threshold keeps the key hot with fewer replicas
+	read(conf.HotThreshold / 2)
+	k.updateHotKeys(time.Now())
+	hot = k.Hot.List()
+	assertIntEqual(1, len(hot), "Key cooled too early", t)
+	assertTrue(len(hot[0].Replicas) <= conf.K/2, "Replicas not reduced", t)
+
+	k.updateHotKeys(time.Now())
+	assertIntEqual(0, len(k.Hot.List()), "Key still hot without reads", t)
+	assertTrue(strings.HasPrefix(k.DoHotKeys(), "OK: 0 hot keys"), "Cooled key listed", t)
+}
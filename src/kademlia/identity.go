@@ -0,0 +1,128 @@
+package kademlia
+
+// Contains the identity file that lets a node keep its ID across restarts.
+// The file is JSON holding the node ID and the addresses of the contacts the
+// node knew when it last saved, which are used as extra seeds on the next
+// start so the node rejoins its old neighbourhood. Each contact is saved as
+// a comma-separated list of all its addresses.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Most contacts written to an identity file.
+const identityContacts = 64
+
+type Identity struct {
+	NodeID   ID
+	Contacts []string // addresses of each contact known when saved
+	Saved    time.Time
+}
+
+type identityJSON struct {
+	NodeID   string    `json:"node_id"`
+	Contacts []string  `json:"contacts"`
+	Saved    time.Time `json:"saved"`
+}
+
+// Read the identity file at path, creating it with a random ID if it does not
+// exist yet. A non-zero override replaces the stored ID and is written back,
+// so later starts without the override keep it.
+func LoadIdentity(path string, override ID) (Identity, error) {
+	var ident Identity
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		ident = Identity{NodeID: NewRandomID(), Contacts: make([]string, 0)}
+		if override != (ID{}) {
+			ident.NodeID = override
+		}
+		return ident, SaveIdentity(path, ident)
+	case err != nil:
+		return ident, err
+	}
+	var j identityJSON
+	if err = json.Unmarshal(data, &j); err != nil {
+		return ident, err
+	}
+	if ident.NodeID, err = parseNodeID(j.NodeID); err != nil {
+		return ident, errors.New("invalid node_id in identity file")
+	}
+	ident.Contacts = j.Contacts
+	if ident.Contacts == nil {
+		ident.Contacts = make([]string, 0)
+	}
+	ident.Saved = j.Saved
+	if override != (ID{}) && override != ident.NodeID {
+		ident.NodeID = override
+		return ident, SaveIdentity(path, ident)
+	}
+	return ident, nil
+}
+
+// Write an identity file. The file is replaced atomically so a crash while
+// saving leaves the previous identity in place.
+func SaveIdentity(path string, ident Identity) error {
+	j := identityJSON{ident.NodeID.AsString(), ident.Contacts, ident.Saved}
+	if j.Contacts == nil {
+		j.Contacts = make([]string, 0)
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(data, '\n')); err == nil {
+		// on disk before the rename, or a crash could leave an empty file
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The node's current identity: its ID and up to identityContacts contacts,
+// closest first.
+func (k *Kademlia) Identity() Identity {
+	ident := Identity{NodeID: k.NodeID, Contacts: make([]string, 0), Saved: k.Clock.Now()}
+	buckets := k.AddrBook.Buckets()
+	// buckets are indexed by prefix length, so the closest are last
+	for i := len(buckets) - 1; i >= 0; i-- {
+		for _, c := range buckets[i] {
+			if len(ident.Contacts) == identityContacts {
+				return ident
+			}
+			ident.Contacts = append(ident.Contacts, addressList(c.Addresses()))
+		}
+	}
+	return ident
+}
+
+// The comma-separated form of addrs, as resolveAddressList reads it.
+func addressList(addrs []Address) string {
+	list := make([]string, len(addrs))
+	for i, each := range addrs {
+		list[i] = each.String()
+	}
+	return strings.Join(list, ",")
+}
+
+func (k *Kademlia) SaveIdentity(path string) error {
+	return SaveIdentity(path, k.Identity())
+}
@@ -0,0 +1,83 @@
+package kademlia
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func Test_LoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity")
+	created, err := LoadIdentity(path, ID{})
+	assertTrue(err == nil, "Identity file not created", t)
+	assertTrue(created.NodeID != (ID{}), "Created identity has no ID", t)
+	reused, err := LoadIdentity(path, ID{})
+	assertTrue(err == nil, "Identity file not read", t)
+	assertTrue(reused.NodeID.Equals(created.NodeID), "ID changed between starts", t)
+
+	override := NewRandomID()
+	ident, _ := LoadIdentity(path, override)
+	assertTrue(ident.NodeID.Equals(override), "Override ignored", t)
+	ident, _ = LoadIdentity(path, ID{})
+	assertTrue(ident.NodeID.Equals(override), "Override not kept", t)
+
+	bad := writeTestFile(t, t.TempDir(), "identity", `{"node_id": "abc"}`)
+	_, err = LoadIdentity(bad, ID{})
+	assertTrue(err != nil, "Short node ID accepted", t)
+}
+
+func Test_RestartKeepsIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity")
+	conf := DefaultConfig()
+	conf.NodeID = NewRandomID()
+	k := NewKademliaWithConfig("localhost:7975", conf)
+	assertTrue(k.NodeID.Equals(conf.NodeID), "Configured ID not used", t)
+	k.DoPing(instance[0].SelfContact.Host, instance[0].SelfContact.Port)
+	assertTrue(k.SaveIdentity(path) == nil, "Identity not saved", t)
+
+	ident, err := LoadIdentity(path, ID{})
+	assertTrue(err == nil, "Saved identity not read", t)
+	assertTrue(ident.NodeID.Equals(k.NodeID), "Saved ID differs", t)
+	seed := addressList(instance[0].SelfContact.Addresses())
+	found := false
+	for _, each := range ident.Contacts {
+		found = found || each == seed
+	}
+	assertTrue(found, "Known contact not saved", t)
+}
+
+/*
+ * A node stopped and started again from its identity file comes back with the
+ * same ID and rejoins through the contacts it knew.
+ */
+func Test_RestartFromIdentityFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity")
+	ident, err := LoadIdentity(path, ID{})
+	assertTrue(err == nil, "Identity file not created", t)
+	conf := DefaultConfig()
+	conf.NodeID = ident.NodeID
+	l, err := net.Listen("tcp", "localhost:7989")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := NewKademliaWithListeners([]net.Listener{l}, conf)
+	assertTrue(err == nil, "First node not started", t)
+	go http.Serve(l, first.Handler())
+	first.DoPing(instance[0].SelfContact.Host, instance[0].SelfContact.Port)
+	assertTrue(first.SaveIdentity(path) == nil, "Identity not saved", t)
+	l.Close()
+	if first.udp != nil {
+		first.udp.Close()
+	}
+
+	ident, err = LoadIdentity(path, ID{})
+	assertTrue(err == nil, "Saved identity not read", t)
+	conf = DefaultConfig()
+	conf.NodeID = ident.NodeID
+	second := NewKademliaWithConfig("localhost:7989", conf)
+	assertTrue(second.NodeID.Equals(first.NodeID), "Restarted node has a new ID", t)
+	result, err := second.Bootstrap(ident.Contacts)
+	assertTrue(err == nil, "Restarted node could not rejoin", t)
+	assertIntEqual(1, result.Reached, "Saved contact not reached", t)
+}
@@ -5,13 +5,15 @@ package kademlia
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -33,66 +35,185 @@ type VdoPair struct {
 
 // Kademlia type. You can put whatever state you need in this.
 type Kademlia struct {
+	Config      Config
+	Clock       Clock
 	NodeID      ID
 	SelfContact Contact
-	LocalData   map[ID][]byte
+	LocalData   *DataStore
 	AddrBook    *KBuckets
-
-	addDataChan  chan Pair
-	findDataChan chan ID
-	resChan      chan []byte
+	Hot         *HotKeys
 
 	VdoData     map[ID]*VanashingDataObject
 	addVdoChan  chan VdoPair
 	findVdoChan chan ID
 	resVdoChan  chan *VanashingDataObject
+	listVdoChan chan bool
+	listVdoRes  chan []VdoPair
+
+	Reputation  *Reputation
+	replay      *ReplayCache
+	Metrics     *Metrics
+	Logger      Logger
+	Events      *Events
+	udp         *UDPTransport
+	listenAddrs []Address       // addresses the listeners are bound to
+	sources     sourceAddresses // local addresses to connect from
 }
 
 func NewKademlia(laddr string) *Kademlia {
-	// TODO: Initialize other state here as you add functionality.
-	k := new(Kademlia)
-	k.NodeID = NewRandomID()
-	k.LocalData = make(map[ID][]byte)
+	return NewKademliaWithConfig(laddr, DefaultConfig())
+}
 
-	k.addDataChan = make(chan Pair)
-	k.findDataChan = make(chan ID)
-	k.resChan = make(chan []byte)
+// Listen on laddr, which may be a comma-separated list of addresses, and serve
+// the node there until the process exits.
+func NewKademliaWithConfig(laddr string, conf Config) *Kademlia {
+	if err := conf.Validate(); err != nil {
+		log.Fatal("Config: ", err)
+	}
+	listeners, err := listenAll(laddr)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	k, err := NewKademliaWithListeners(listeners, conf)
+	if err != nil {
+		log.Fatal("Kademlia: ", err)
+	}
+	// Run RPC server forever.
+	handler := k.Handler()
+	for _, l := range listeners {
+		go http.Serve(l, handler)
+	}
+	return k
+}
 
-	go k.MessageWorker()
+// Build a node reachable through the given listeners without serving them.
+// The caller serves Handler() on them, or mounts the node on its own mux with
+// Mount. UDP is opened on the same addresses. The node advertises
+// conf.Advertise if set, otherwise the listeners' addresses.
+func NewKademliaWithListeners(listeners []net.Listener, conf Config) (*Kademlia, error) {
+	// TODO: Initialize other state here as you add functionality.
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners")
+	}
+	addrs, err := resolveAddressList(conf.Advertise)
+	if err != nil {
+		return nil, err
+	}
+	k := new(Kademlia)
+	k.Config = conf
+	k.NodeID = conf.NodeID
+	if k.NodeID == (ID{}) {
+		k.NodeID = NewRandomID()
+	}
+	k.Clock = conf.Clock
+	if k.Clock == nil {
+		k.Clock = SystemClock
+	}
+	k.Logger = conf.Logger
+	if k.Logger == nil {
+		k.Logger = QuietLogger{}
+	}
+	k.LocalData = NewDataStore()
+	k.LocalData.Clock = k.Clock
+	k.Hot = NewHotKeys()
+	k.Events = NewEvents()
+	k.Events.Clock = k.Clock
 
 	k.VdoData = make(map[ID]*VanashingDataObject)
 	k.addVdoChan = make(chan VdoPair)
 	k.findVdoChan = make(chan ID)
 	k.resVdoChan = make(chan *VanashingDataObject)
+	k.listVdoChan = make(chan bool)
+	k.listVdoRes = make(chan []VdoPair)
 	go k.VdoWorker()
+	go k.expireWorker()
+
+	k.Reputation = NewReputation(conf.BanThreshold, conf.BanDuration)
+	k.Reputation.Clock = k.Clock
+	k.replay = NewReplayCache(conf.EnvelopeWindow)
+	k.Metrics = NewMetrics()
 	// Set up RPC server
 	// NOTE: KademliaCore is just a wrapper around Kademlia. This type includes
 	// the RPC functions.
-	srv := rpc.NewServer()
-	srv.Register(&KademliaCore{k})
-	_, port, _ := net.SplitHostPort(laddr)
-	srv.HandleHTTP(rpc.DefaultRPCPath+port, rpc.DefaultDebugPath+port)
-	l, err := net.Listen("tcp", laddr)
-	if err != nil {
-		log.Fatal("Listen: ", err)
+	core := &KademliaCore{k, nil}
+	k.udp, err = NewUDPTransport(core, listeners, conf.UDPTimeout, conf.UDPRetries)
+	if err != nil && conf.UDP {
+		return nil, err
 	}
-	// Run RPC server forever.
-	go http.Serve(l, nil)
-
-	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
-	port_int, _ := strconv.Atoi(port)
-	ipAddrStrings, err := net.LookupHost(hostname)
-	var host net.IP
-	for i := 0; i < len(ipAddrStrings); i++ {
-		host = net.ParseIP(ipAddrStrings[i])
-		if host.To4() != nil {
-			break
+
+	// Add self contact from the advertised addresses, preferring IPv4
+	k.listenAddrs = listenerAddresses(listeners)
+	k.sources = listenerSources(listeners)
+	if len(addrs) == 0 {
+		addrs = k.listenAddrs
+	}
+	k.SelfContact = Contact{k.NodeID, addrs[0].Host, addrs[0].Port, addrs[1:]}
+	k.AddrBook = NewKBuckets(k.SelfContact, conf.K, KBucketsOptions{
+		Events:     k.Events,
+		Limits:     conf.diversityLimits(),
+		Reputation: k.Reputation,
+		Clock:      k.Clock,
+		Ping:       k.pingContact,
+	})
+	if conf.HotThreshold > 0 {
+		go k.hotWorker()
+	}
+	// last, since requests may arrive as soon as UDP is served
+	if k.udp != nil {
+		k.udp.Start()
+	}
+	return k, nil
+}
+
+// Register the RPC and metrics endpoints on mux. Paths are suffixed with each
+// advertised and listening port, which is the path peers dial.
+func (k *Kademlia) Mount(mux *http.ServeMux) {
+	mounted := make(map[uint16]bool)
+	for _, a := range append(k.SelfContact.Addresses(), k.listenAddrs...) {
+		if mounted[a.Port] {
+			continue
 		}
+		mounted[a.Port] = true
+		port := strconv.Itoa(int(a.Port))
+		mux.Handle(rpc.DefaultRPCPath+port, k.rpcHandler())
+		mux.Handle(MetricsPath+port, k.metricsHandler())
 	}
-	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
-	k.AddrBook = BuildKBuckets(k.SelfContact)
-	return k
+}
+
+// Serve net/rpc over HTTP CONNECT as rpc.Server does, with a server for each
+// connection so the handlers know the address requests come from.
+func (k *Kademlia) rpcHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			io.WriteString(w, "405 must CONNECT\n")
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			k.Logger.Warn("rpc hijack failed", F("peer", req.RemoteAddr), F("err", err))
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+		var source net.IP
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			source = net.ParseIP(host)
+		}
+		server := rpc.NewServer()
+		server.Register(&KademliaCore{k, source})
+		server.ServeConn(conn)
+	})
+}
+
+// Return a handler serving only this node.
+func (k *Kademlia) Handler() http.Handler {
+	mux := http.NewServeMux()
+	k.Mount(mux)
+	return mux
 }
 
 type NotFoundError struct {
@@ -114,49 +235,83 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	return k.AddrBook.FindOne(nodeId)
 }
 
-func (k Kademlia) MessageWorker() {
-	// loop forever
-	for {
-		select {
-		case pair := <-k.addDataChan:
-			k.LocalData[pair.key] = pair.value
+func (k Kademlia) addData(p Pair) {
+	k.addDataFrom(p, ValueOrigin{Kind: OriginLocal}, k.Clock.Now())
+}
 
-		case key := <-k.findDataChan:
-			// check if key is in LocalData
-			if value, ok := k.LocalData[key]; ok {
-				k.resChan <- value
-			} else {
-				k.resChan <- nil
-			}
+// Store a pair locally. Cached copies expire after Config.CacheTTL and do not
+// replace a value held for good.
+func (k Kademlia) addDataFrom(p Pair, origin ValueOrigin, at time.Time) {
+	k.addDataFor(p, origin, at, k.Config.CacheTTL)
+}
+
+// Store a pair locally, a cached copy expiring after ttl.
+func (k Kademlia) addDataFor(p Pair, origin ValueOrigin, at time.Time, ttl time.Duration) {
+	var expires time.Time
+	if origin.Kind == OriginCache {
+		expires = at.Add(ttl)
+	}
+	if k.LocalData.Put(p.key, p.value, origin, at, expires) {
+		k.Events.emit(Event{Kind: EventValueStored, Key: p.key, Size: len(p.value)})
+	}
+}
+
+// Drop cached copies once they expire.
+func (k *Kademlia) expireWorker() {
+	interval := k.Config.CacheTTL / 4
+	if interval < cacheSweepMin {
+		interval = cacheSweepMin
+	}
+	tick := k.Clock.NewTicker(interval)
+	for now := range tick.Chan() {
+		for _, info := range k.LocalData.Expire(now) {
+			k.Events.emit(Event{Kind: EventValueExpired, Key: info.Key, Size: info.Size})
 		}
 	}
 }
 
-func (k Kademlia) addData(p Pair) {
-	k.addDataChan <- p
+// Return the known contacts closer to key than this node, or nil if this node
+// is among the k closest it knows of.
+func (k *Kademlia) closerContacts(key ID) []Contact {
+	own := key.Xor(k.NodeID)
+	closer := make([]Contact, 0, k.Config.K)
+	for _, each := range k.AddrBook.Find(key) {
+		if key.Xor(each.NodeID).Less(own) {
+			closer = append(closer, each)
+		}
+	}
+	if len(closer) < k.Config.K {
+		return nil
+	}
+	sort.Slice(closer, func(i, j int) bool {
+		return key.Xor(closer[i].NodeID).Less(key.Xor(closer[j].NodeID))
+	})
+	return closer
 }
 
 func (k Kademlia) getData(key ID) ([]byte, error) {
-	k.findDataChan <- key
-	result := <-k.resChan
-
-	if result != nil {
-		return result, nil
+	if value, ok := k.LocalData.Get(key); ok {
+		return value, nil
 	}
 	return nil, &NotFoundError{key, "Key does not exist"}
 }
 
+// Return the number of keys and bytes of values held in LocalData.
+func (k Kademlia) dataStats() (keys int, size int) {
+	return k.LocalData.Stats()
+}
+
 func PingHelper(self Contact, host net.IP, port uint16) (*PongMessage, error) {
-	port_str := strconv.Itoa(int(port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		fmt.Sprintf("%s:%d", host.String(), port),
-		rpc.DefaultRPCPath+port_str)
+	return pingAddresses(self, baseCapabilities, []Address{{host, port}})
+}
+
+func pingAddresses(self Contact, caps Capabilities, addrs []Address) (*PongMessage, error) {
+	client, err := dialAddresses(addrs)
 	if err != nil {
 		return nil, err
 	}
 	defer client.Close()
-	ping := PingMessage{self, NewRandomID()}
+	ping := PingMessage{self, NewRandomID(), caps, NewEnvelope()}
 	var pong PongMessage
 
 	err = client.Call("KademliaCore.Ping", ping, &pong)
@@ -164,109 +319,223 @@ func PingHelper(self Contact, host net.IP, port uint16) (*PongMessage, error) {
 		client.Close()
 		return nil, err
 	}
+	if err = validateResponse(ping.MsgID, pong.MsgID); err != nil {
+		return &pong, err
+	}
 	return &pong, nil
 }
 
 // ========================== RPC client code =========================
+// Send an RPC over UDP when enabled and shared with the peer, otherwise (or
+// when UDP gives up) over net/rpc through each address in turn. The peer may
+// have handled a UDP request whose reply was lost, and would refuse it again
+// as a replay, so the TCP retry goes out under a fresh MsgID, left in msgId.
+func (k *Kademlia) callAddresses(shared Capabilities, addrs []Address, method string, msgId *ID, req, res interface{}) error {
+	if k.Config.UDP && shared.Has(CapUDP) {
+		err := k.udp.Call(addrs, *msgId, req, res)
+		k.Metrics.UDPRequest(method, err == errUDPFallback)
+		if err != errUDPFallback {
+			return err
+		}
+		*msgId = NewRandomID()
+		req = withMsgID(req, *msgId)
+	}
+	client, err := dialAddressesFrom(k.sources, addrs, k.Config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call("KademliaCore."+method, req, res)
+}
+
+// Record metrics and a log line for an RPC we sent.
+func (k *Kademlia) sentRPC(name string, start time.Time, err error, fields ...Field) {
+	took := k.Clock.Now().Sub(start)
+	k.Metrics.RPCSent(name, took, err)
+	fields = append(fields, F("rpc", name), F("duration", took))
+	if err == nil {
+		k.Logger.Debug("rpc sent", fields...)
+	} else {
+		k.Logger.Warn("rpc failed", append(fields, F("err", err))...)
+	}
+}
+
 // This is the function to perform the RPC
 func (k *Kademlia) DoPing(host net.IP, port uint16) string {
 	// TODO: Implement
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	pong, err := PingHelper(k.SelfContact, host, port)
+	return k.DoPingAddresses([]Address{{host, port}})
+}
+
+// Ping a node through each of its addresses until one answers, returning the
+// contact that answered.
+func (k *Kademlia) PingAddresses(addrs []Address) (sender Contact, err error) {
+	start := k.Clock.Now()
+	defer func() { k.sentRPC("ping", start, err, F("addrs", addrs)) }()
+	ping := PingMessage{k.SelfContact, NewRandomID(), k.Capabilities(), NewEnvelope()}
+	var pong PongMessage
+	// nothing is negotiated before the PONG, so PING always goes over TCP
+	err = k.callAddresses(0, addrs, "Ping", &ping.MsgID, ping, &pong)
+	if err == nil {
+		err = k.checkResponse(pong.Sender, ping.MsgID, pong.MsgID)
+	}
 	if err != nil {
-		fmt.Println("ERR: " + err.Error())
-		return "ERR: " + err.Error()
+		return sender, err
 	}
-	k.AddrBook.Update(pong.Sender)
-	return "OK: Ping " + pong.Sender.NodeID.AsString()
+	info := PeerInfo{negotiatedVersion(pong.Version), pong.Capabilities}
+	k.AddrBook.UpdatePeer(pong.Sender, info)
+	return pong.Sender, nil
 }
 
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
-	// TODO: Implement
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int((*contact).Port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port),
-		rpc.DefaultRPCPath+port_str,
-	)
-	if err != nil {
-		fmt.Println("ERR: " + err.Error())
-		return "ERR: " + err.Error()
+// Ping c as PingAddresses does, counting a failure against it, but leave the
+// routing table alone: the table calls this to check the oldest contact of a
+// full bucket before evicting it.
+func (k *Kademlia) pingContact(c Contact) (err error) {
+	start := k.Clock.Now()
+	defer func() { k.sentRPC("ping", start, err, F("peer", c.NodeID)) }()
+	ping := PingMessage{k.SelfContact, NewRandomID(), k.Capabilities(), NewEnvelope()}
+	var pong PongMessage
+	if err = k.callAddresses(0, c.Addresses(), "Ping", &ping.MsgID, ping, &pong); err != nil {
+		k.recordViolation(c, Timeout)
+		return err
 	}
-	defer client.Close()
+	return k.checkResponse(c, ping.MsgID, pong.MsgID)
+}
 
-	req := StoreRequest{k.SelfContact, NewRandomID(), key, value}
-	var res StoreResult
+// Store a value on contact. A refusal is returned as a *ProtocolError.
+func (k *Kademlia) Store(contact *Contact, key ID, value []byte) error {
+	_, _, err := k.storeValue(contact, key, value, false, 0)
+	return err
+}
 
-	err = client.Call("KademliaCore.Store", req, &res)
+// Ask contact to store value, as a cached copy kept for ttl (the contact's
+// CacheTTL if zero) if cache is set. A refusal is returned as a
+// *ProtocolError; for ErrNotResponsible closer holds the contacts the node
+// suggested instead. The whole result is returned as well.
+func (k *Kademlia) storeValue(contact *Contact, key ID, value []byte, cache bool, ttl time.Duration) (res StoreResult, closer []Contact, err error) {
+	start := k.Clock.Now()
+	msgId := NewRandomID()
+	defer func() {
+		k.sentRPC("store", start, err, F("peer", contact.NodeID), F("msgid", msgId))
+	}()
+	req := StoreRequest{k.SelfContact, msgId, key, value, cache, ttl, NewEnvelope()}
+	err = k.callAddresses(k.sharedCapabilities(contact.NodeID, 0), contact.Addresses(), "Store", &msgId, req, &res)
 	if err != nil {
-		client.Close()
-		fmt.Println("ERR: " + err.Error())
-		return "ERR: " + err.Error()
+		k.recordViolation(*contact, Timeout)
+	} else {
+		err = k.checkResponse(*contact, msgId, res.MsgID)
 	}
+	if err == nil {
+		err = res.Err.Err()
+	}
+	if errors.Is(err, ErrNotResponsible) {
+		closer = k.checkContacts(*contact, res.Nodes)
+	}
+	return res, closer, err
+}
 
-	return "OK:"
+// Ask contact for the nodes it knows closest to searchKey. A refusal is
+// returned as a *ProtocolError.
+func (k *Kademlia) FindNode(contact *Contact, searchKey ID) (nodes []Contact, err error) {
+	start := k.Clock.Now()
+	msgId := NewRandomID()
+	defer func() {
+		k.sentRPC("find_node", start, err, F("peer", contact.NodeID), F("msgid", msgId))
+	}()
+	req := FindNodeRequest{k.SelfContact, msgId, searchKey, NewEnvelope()}
+	var res FindNodeResult
+	err = k.callAddresses(k.sharedCapabilities(contact.NodeID, 0), contact.Addresses(), "FindNode", &msgId, req, &res)
+	if err != nil {
+		k.recordViolation(*contact, Timeout)
+	} else {
+		err = k.checkResponse(*contact, msgId, res.MsgID)
+	}
+	if err == nil {
+		err = res.Err.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	nodes = k.checkContacts(*contact, res.Nodes)
+	for _, each := range nodes {
+		k.AddrBook.Update(each)
+	}
+	return nodes, nil
 }
 
-func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
-	// TODO: Implement
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int((*contact).Port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port),
-		rpc.DefaultRPCPath+port_str,
-	)
+// Ask contact for the value of searchKey. Either the value or the closest
+// nodes it knows is set. A refusal is returned as a *ProtocolError.
+func (k *Kademlia) FindValue(contact *Contact, searchKey ID) (value []byte, nodes []Contact, err error) {
+	res, nodes, err := k.findValue(contact, searchKey)
+	return res.Value, nodes, err
+}
+
+// FindValue returning the whole result, which tells cached copies apart.
+func (k *Kademlia) findValue(contact *Contact, searchKey ID) (res FindValueResult, nodes []Contact, err error) {
+	start := k.Clock.Now()
+	msgId := NewRandomID()
+	defer func() {
+		k.sentRPC("find_value", start, err, F("peer", contact.NodeID), F("msgid", msgId))
+	}()
+	req := FindValueRequest{k.SelfContact, msgId, searchKey, NewEnvelope()}
+	err = k.callAddresses(k.sharedCapabilities(contact.NodeID, 0), contact.Addresses(), "FindValue", &msgId, req, &res)
 	if err != nil {
-		fmt.Println("ERR: " + err.Error())
-		return "ERR: " + err.Error()
+		k.recordViolation(*contact, Timeout)
+	} else {
+		err = k.checkResponse(*contact, msgId, res.MsgID)
+	}
+	if err == nil {
+		err = res.Err.Err()
 	}
-	defer client.Close()
-	req := FindNodeRequest{k.SelfContact, NewRandomID(), searchKey}
-	var res FindNodeResult
-	err = client.Call("KademliaCore.FindNode", req, &res)
 	if err != nil {
-		client.Close()
-		fmt.Println("ERR: " + err.Error())
-		return "ERR: " + err.Error()
+		return res, nil, err
 	}
-	for _, each := range res.Nodes {
+	nodes = k.checkContacts(*contact, res.Nodes)
+	for _, each := range nodes {
 		k.AddrBook.Update(each)
 	}
-	return fmt.Sprintf("OK: Found %d Nodes", len(res.Nodes))
+	return res, nodes, nil
 }
 
-func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
+// Ping a node through each of its addresses until one answers.
+func (k *Kademlia) DoPingAddresses(addrs []Address) string {
+	sender, err := k.PingAddresses(addrs)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: Ping " + sender.NodeID.AsString()
+}
+
+func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
+	// TODO: Implement
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	if err := k.Store(contact, key, value); err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK:"
+}
+
+func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
 	// TODO: Implement
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int((*contact).Port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port),
-		rpc.DefaultRPCPath+port_str,
-	)
+	nodes, err := k.FindNode(contact, searchKey)
 	if err != nil {
-		fmt.Println("ERR: " + err.Error())
 		return "ERR: " + err.Error()
 	}
-	defer client.Close()
-	req := FindValueRequest{k.SelfContact, NewRandomID(), searchKey}
-	var res FindValueResult
+	return fmt.Sprintf("OK: Found %d Nodes", len(nodes))
+}
 
-	err = client.Call("KademliaCore.FindValue", req, &res)
+func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
+	// TODO: Implement
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	value, nodes, err := k.FindValue(contact, searchKey)
 	if err != nil {
-		client.Close()
-		fmt.Println("ERR: " + err.Error())
 		return "ERR: " + err.Error()
 	}
-	if res.Value != nil {
-		return "OK: Found value: " + string(res.Value)
-	} else if res.Nodes != nil {
-		for _, each := range res.Nodes {
-			k.AddrBook.Update(each)
-		}
-		return fmt.Sprintf("OK: Found nodes: %d\n", len(res.Nodes))
+	if value != nil {
+		return "OK: Found value: " + string(value)
+	} else if nodes != nil {
+		return fmt.Sprintf("OK: Found nodes: %d\n", len(nodes))
 	} else {
 		return "ERR: Not Found"
 	}
@@ -291,16 +560,30 @@ func (k *Kademlia) DoIterativeFindNode(id ID) string {
 	return buffer.String()
 }
 
+func (k *Kademlia) lookupDone(name string, id ID, hops int) {
+	k.Metrics.LookupDone(name, hops)
+	k.Events.emit(Event{Kind: EventLookupDone, Key: id, RPC: name, Hops: hops})
+}
+
+// A reply to one of the FIND_NODE requests of a lookup.
+type findNodeReply struct {
+	contact Contact
+	err     error
+}
+
 func (k *Kademlia) iterativeFindNode(id ID) []Contact {
-	findCh := make(chan *Contact, alpha)
-	resCh := make(chan string, alpha)
+	findCh := make(chan *Contact, k.Config.Alpha)
+	resCh := make(chan findNodeReply, k.Config.Alpha)
 	go k.callFindNode(id, findCh, resCh)
 	shortlist := k.AddrBook.Find(id)
 	statusMap := make(map[ID]int)
+	hops := 0
+	defer func() { k.lookupDone("find_node", id, hops) }()
 	for !validate(&statusMap, &shortlist) {
-		todo := make([]Contact, 0, 3)
+		hops++
+		todo := make([]Contact, 0, k.Config.Alpha)
 		j := 0
-		for i := 0; j < alpha && i < len(shortlist); i++ {
+		for i := 0; j < k.Config.Alpha && i < len(shortlist); i++ {
 			each := shortlist[i]
 			if _, ok := statusMap[each.NodeID]; !ok {
 				findCh <- &each
@@ -309,70 +592,121 @@ func (k *Kademlia) iterativeFindNode(id ID) []Contact {
 				j++
 			}
 		}
-		for i := 0; i < len(todo); i++ {
+		timeout := time.After(k.Config.FindNodeTimeout)
+		for pending := len(todo); pending > 0; {
 			select {
-			case s := <-resCh:
-				if strings.Contains(s, "OK:") {
-					statusMap[todo[i].NodeID] = 1
+			case r := <-resCh:
+				// replies that come after their round timed out still count
+				if statusMap[r.contact.NodeID] == 0 {
+					pending--
+				}
+				if r.err == nil {
+					statusMap[r.contact.NodeID] = 1
 				} else {
-					statusMap[todo[i].NodeID] = 2
-					fmt.Println(todo[i].NodeID.AsString() + " " + s)
-					k.AddrBook.Remove(todo[i].NodeID)
+					statusMap[r.contact.NodeID] = 2
+					k.Logger.Warn("lookup contact failed",
+						F("rpc", "find_node"), F("peer", r.contact.NodeID), F("err", r.err))
 				}
-			case <-time.After(time.Millisecond * 1000):
-				statusMap[todo[i].NodeID] = 2
-				fmt.Println(todo[i].NodeID.AsString() + " timed out")
+			case <-timeout:
+				k.timedOut("find_node", statusMap, todo)
+				pending = 0
 			}
 		}
 		shortlist = k.AddrBook.Find(id)
 	}
-	return shortlist
+	return answered(statusMap, shortlist)
 }
 
+// Mark the contacts of todo that have not answered yet as failed.
+func (k *Kademlia) timedOut(name string, statusMap map[ID]int, todo []Contact) {
+	for _, each := range todo {
+		if statusMap[each.NodeID] == 0 {
+			statusMap[each.NodeID] = 2
+			k.Metrics.LookupTimeout(name)
+			k.Logger.Warn("lookup contact timed out", F("rpc", name), F("peer", each.NodeID))
+		}
+	}
+}
+
+// Whether every contact of the shortlist has been asked. Contacts that failed
+// count as asked: they stay in the routing table until the reputation tracker
+// finds them stale, and are left out of the result by answered.
 func validate(statusMap *map[ID]int, shortlist *[]Contact) bool {
 	for _, each := range *shortlist {
-		if v, ok := (*statusMap)[each.NodeID]; !ok {
-			return false
-		} else if v != 1 {
+		if _, ok := (*statusMap)[each.NodeID]; !ok {
 			return false
 		}
 	}
 	return true
 }
 
-func (k *Kademlia) callFindNode(id ID, findCh chan *Contact, resCh chan string) {
+// The contacts of the shortlist that did not fail to answer.
+func answered(statusMap map[ID]int, shortlist []Contact) []Contact {
+	result := make([]Contact, 0, len(shortlist))
+	for _, each := range shortlist {
+		if statusMap[each.NodeID] != 2 {
+			result = append(result, each)
+		}
+	}
+	return result
+}
+
+func (k *Kademlia) callFindNode(id ID, findCh chan *Contact, resCh chan findNodeReply) {
 	for {
 		select {
 		case con := <-findCh:
-			resCh <- k.DoFindNode(con, id)
+			_, err := k.FindNode(con, id)
+			resCh <- findNodeReply{*con, err}
 		}
 	}
 }
 
 func (k *Kademlia) DoIterativeStore(key ID, value []byte) string {
-	contacts := k.iterativeFindNode(key)
 	var buffer bytes.Buffer
-	for _, each := range contacts {
-		s := k.DoStore(&each, key, value)
-		if strings.Contains(s, "OK:") {
-			buffer.WriteString(each.NodeID.AsString() + "\n")
-		}
+	for _, each := range k.iterativeStore(key, value) {
+		buffer.WriteString(each.NodeID.AsString() + "\n")
 	}
 	return buffer.String()
 }
 
+// Store a value on the closest nodes to key. Returns the contacts that
+// accepted it.
+func (k *Kademlia) iterativeStore(key ID, value []byte) []Contact {
+	return k.storeOn(k.iterativeFindNode(key), key, value)
+}
+
+// Store on every contact, following the closer contacts suggested by nodes
+// that refuse as not responsible until k nodes hold the value or there is no
+// one left to try. Returns the contacts that accepted it.
+func (k *Kademlia) storeOn(contacts []Contact, key ID, value []byte) []Contact {
+	stored := make([]Contact, 0, len(contacts))
+	tried := make(map[ID]bool)
+	for len(contacts) > 0 && len(stored) < k.Config.K {
+		next := make([]Contact, 0)
+		for _, each := range contacts {
+			if tried[each.NodeID] || each.NodeID == k.NodeID {
+				continue
+			}
+			tried[each.NodeID] = true
+			_, closer, err := k.storeValue(&each, key, value, false, 0)
+			if err == nil {
+				stored = append(stored, each)
+			}
+			next = append(next, closer...)
+		}
+		contacts = next
+	}
+	return stored
+}
+
 func (k *Kademlia) DoIterativeFindValue(key ID) string {
 	contacts, value := k.iterativeFindValue(key)
 	var buffer bytes.Buffer
-	if value != "" {
-		k.addData(Pair{key, []byte(value)})
-		for _, each := range contacts {
-			s := k.DoStore(&each, key, []byte(value))
-			if strings.Contains(s, "OK:") {
-				buffer.WriteString(each.NodeID.AsString() + "\n")
-			}
+	if value != nil {
+		for _, each := range k.cacheValue(key, value, contacts) {
+			buffer.WriteString(each.NodeID.AsString() + "\n")
 		}
-		buffer.WriteString(value)
+		buffer.Write(value)
 	} else {
 		for _, each := range contacts {
 			buffer.WriteString(each.NodeID.AsString() + "\n")
@@ -381,16 +715,48 @@ func (k *Kademlia) DoIterativeFindValue(key ID) string {
 	return buffer.String()
 }
 
-func (k *Kademlia) iterativeFindValue(id ID) ([]Contact, string) {
-	valueCh := make(chan *Contact, alpha)
-	resCh := make(chan string, alpha)
+// Keep a found value locally and store a cached copy on the closest contact
+// of the lookup, as the spec does, rather than on all of them: popular keys
+// are spread further by the nodes holding them, see hot.go. contacts are the
+// ones that answered without the value, since a node holding it for good
+// keeps its copy. Returns the contacts that accepted it.
+func (k *Kademlia) cacheValue(key ID, value []byte, contacts []Contact) []Contact {
+	k.addDataFrom(Pair{key, value}, ValueOrigin{Kind: OriginCache}, k.Clock.Now())
+	for _, each := range contacts {
+		if each.NodeID == k.NodeID {
+			continue
+		}
+		if _, _, err := k.storeValue(&each, key, value, true, 0); err == nil {
+			return []Contact{each}
+		}
+	}
+	return []Contact{}
+}
+
+// A reply to one of the FIND_VALUE requests of a lookup, value is nil if the
+// contact answered with nodes.
+type findValueReply struct {
+	contact Contact
+	value   []byte
+	err     error
+}
+
+// Look for the value of id, nil if not found. If found, the contacts returned
+// are the ones that answered without it, closest first; otherwise those that
+// did not fail.
+func (k *Kademlia) iterativeFindValue(id ID) ([]Contact, []byte) {
+	valueCh := make(chan *Contact, k.Config.Alpha)
+	resCh := make(chan findValueReply, k.Config.Alpha)
 	go k.callFindValue(id, valueCh, resCh)
 	shortlist := k.AddrBook.Find(id)
 	statusMap := make(map[ID]int)
+	hops := 0
+	defer func() { k.lookupDone("find_value", id, hops) }()
 	for !validate(&statusMap, &shortlist) {
-		todo := make([]Contact, 0, 3)
+		hops++
+		todo := make([]Contact, 0, k.Config.Alpha)
 		j := 0
-		for i := 0; j < alpha && i < len(shortlist); i++ {
+		for i := 0; j < k.Config.Alpha && i < len(shortlist); i++ {
 			each := shortlist[i]
 			if _, ok := statusMap[each.NodeID]; !ok {
 				valueCh <- &each
@@ -399,34 +765,51 @@ func (k *Kademlia) iterativeFindValue(id ID) ([]Contact, string) {
 				j++
 			}
 		}
-		for i := 0; i < len(todo); i++ {
+		timeout := time.After(k.Config.FindValueTimeout)
+		for pending := len(todo); pending > 0; {
 			select {
-			case s := <-resCh:
-				if strings.Contains(s, "value") {
-					value := s[17:]
-					return shortlist, value
-				} else if strings.Contains(s, "OK:") {
-					statusMap[todo[i].NodeID] = 1
-				} else {
-					statusMap[todo[i].NodeID] = 2
-					k.AddrBook.Remove(todo[i].NodeID)
+			case r := <-resCh:
+				if statusMap[r.contact.NodeID] == 0 {
+					pending--
+				}
+				switch {
+				case r.err != nil:
+					statusMap[r.contact.NodeID] = 2
+				case r.value != nil:
+					return withoutValue(statusMap, shortlist), r.value
+				default:
+					statusMap[r.contact.NodeID] = 1
 				}
-			case <-time.After(time.Millisecond * 300):
-				statusMap[todo[i].NodeID] = 2
+			case <-timeout:
+				k.timedOut("find_value", statusMap, todo)
+				pending = 0
 			}
 		}
 		shortlist = k.AddrBook.Find(id)
 	}
-	return shortlist, ""
+	return answered(statusMap, shortlist), nil
 }
 
-func (k *Kademlia) callFindValue(id ID, valueCh chan *Contact, resCh chan string) {
+func (k *Kademlia) callFindValue(id ID, valueCh chan *Contact, resCh chan findValueReply) {
 	for {
 		select {
 		case con := <-valueCh:
-			resCh <- k.DoFindValue(con, id)
+			value, _, err := k.FindValue(con, id)
+			resCh <- findValueReply{*con, value, err}
+		}
+	}
+}
+
+// The contacts of the shortlist that answered without the value. Those still
+// to answer may hold it.
+func withoutValue(statusMap map[ID]int, shortlist []Contact) []Contact {
+	result := make([]Contact, 0, len(shortlist))
+	for _, each := range shortlist {
+		if statusMap[each.NodeID] == 1 {
+			result = append(result, each)
 		}
 	}
+	return result
 }
 
 // ========================== Vanish =========================
@@ -436,24 +819,26 @@ func (k Kademlia) DoVanish(id ID, data []byte, numberKeys, threshold, timeout by
 	return "OK:"
 }
 
-func (k Kademlia) DoUnvanish(contact *Contact, vdoId ID) string {
-	port_str := strconv.Itoa(int((*contact).Port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port),
-		rpc.DefaultRPCPath+port_str,
-	)
+func (k Kademlia) DoUnvanish(contact *Contact, vdoId ID) (response string) {
+	start := k.Clock.Now()
+	msgId := NewRandomID()
+	defer func() {
+		k.sentRPC("get_vdo", start, responseError(response), F("peer", contact.NodeID), F("msgid", msgId))
+	}()
+
+	client, err := dialAddressesFrom(k.sources, contact.Addresses(), k.Config.DialTimeout)
 	if err != nil {
-		fmt.Println("ERR: " + err.Error())
 		return "ERR: " + err.Error()
 	}
 	defer client.Close()
-	req := GetVDORequest{k.SelfContact, NewRandomID(), vdoId}
+	req := GetVDORequest{k.SelfContact, msgId, vdoId, NewEnvelope()}
 	var res GetVDOResult
 
 	err = client.Call("KademliaCore.GetVDO", req, &res)
+	if err == nil {
+		err = k.checkResponse(*contact, req.MsgID, res.MsgID)
+	}
 	if err != nil {
-		fmt.Println("ERR: " + err.Error())
 		return "ERR: " + err.Error()
 	}
 	if res.VDO.Ciphertext != nil {
@@ -479,6 +864,12 @@ func (k *Kademlia) VdoWorker() {
 			} else {
 				k.resVdoChan <- nil
 			}
+		case <-k.listVdoChan:
+			pairs := make([]VdoPair, 0, len(k.VdoData))
+			for key, vdo := range k.VdoData {
+				pairs = append(pairs, VdoPair{key, vdo})
+			}
+			k.listVdoRes <- pairs
 		}
 	}
 }
@@ -208,6 +208,38 @@ func Test_DoIterativeStoreFindFail(t *testing.T) {
 		t)
 }
 
+/*
+ * The cached copy goes to the closest node that answered without the value,
+ * not to the node the value came from.
+ */
+func Test_CacheSkipsHolder(t *testing.T) {
+	k := NewKademlia("localhost:7992")
+	peer := instance[7].SelfContact
+	k.DoPing(peer.Host, peer.Port)
+	// the holder is the closest node to the key, instance[7] one of the
+	// closest that answers without it
+	var holder Contact
+	for _, each := range instance[7].AddrBook.Find(instance[7].NodeID) {
+		if each.Port >= 7890 && each.Port < 7890+uint16(len(instance)) {
+			holder = each
+			break
+		}
+	}
+	key := holder.NodeID
+	_, _, err := instance[7].storeValue(&holder, key, []byte("cache me"), false, 0)
+	assertTrue(err == nil, "Cannot store the value", t)
+
+	contacts, value := k.iterativeFindValue(key)
+	assertStringEqual("cache me", string(value), "Value not found", t)
+	stored := k.cacheValue(key, value, contacts)
+	assertIntEqual(1, len(stored), "Value not cached at one node", t)
+	assertFalse(stored[0].NodeID == holder.NodeID, "Value cached at its holder", t)
+	res, _, err := k.findValue(&stored[0], key)
+	assertTrue(err == nil && res.Cached, "No cached copy kept", t)
+	res, _, err = k.findValue(&holder, key)
+	assertTrue(err == nil && !res.Cached, "Holder lost its copy", t)
+}
+
 // Vanish test cases
 
 func Test_DoVanishSucc(t *testing.T) {
@@ -222,7 +254,7 @@ func Test_DoVanishSucc(t *testing.T) {
 			to = (rand.Int() % (N - 1)) + 1
 		}
 		vdoId := NewRandomID()
-		vdoData := []byte("vdodata" + string(i))
+		vdoData := []byte("vdodata" + string(rune(i)))
 		fmt.Printf(
 			"Vanish at: %s\nUnvanish at: %s\n",
 			instance[from].NodeID.AsString(),
@@ -1,40 +1,106 @@
 package kademlia
 
+// Contains the routing table. Readers never block: each bucket is an
+// immutable snapshot that lookups load atomically. All changes go through the
+// handleContact goroutine, which copies the bucket it changes and publishes
+// the copy in its place, so a slow eviction ping only holds up other writers.
+// A reader going over several buckets may see them at different versions.
+//
+// Each bucket has a replacement cache of up to K contacts that did not fit:
+// those seen while the bucket was full of live contacts and those over the
+// diversity limits. When a contact is removed, the most recently seen
+// replacement that fits takes its place.
+
 import (
-	"container/list"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 type KBuckets struct {
 	SelfContact Contact
 	SelfId      ID
-	Lists       [b]*list.List
-	updateCh    chan *Contact
-	removeCh    chan ID
-	//channels for find a single contact
-	findCh chan ID
-	resCh  chan *Contact
-	//channels for find k closest contacts with an ID
-	closestCh    chan ID
-	closestResCh chan []Contact
+	K           int
+	Events      *Events
+	Limits      DiversityLimits
+	Reputation  *Reputation // banned contacts are never added
+	Clock       Clock       // when contacts were last seen
+	// checks the oldest contact of a full bucket is still alive
+	ping  func(Contact) error
+	table routingTable
+	//channels for changes, answered on doneCh once the change is visible
+	updateCh chan contactUpdate
+	removeCh chan ID
+	doneCh   chan bool
+}
+
+// The buckets, indexed by prefix length.
+type routingTable struct {
+	buckets [b]atomic.Value // *tableBucket
+}
+
+// One version of a bucket and its replacement cache, each holding the least
+// recently seen contact first. Published versions are never modified.
+type tableBucket struct {
+	entries      []tableEntry
+	replacements []tableEntry
+}
+
+type tableEntry struct {
+	contact Contact
+	// version and capabilities from the contact's last PING or PONG, if any
+	info *PeerInfo
+	seen time.Time // last update
+}
+
+type contactUpdate struct {
+	contact *Contact
+	info    *PeerInfo
 }
 
 // =============== Public API ========================
 func (kb *KBuckets) Update(c Contact) {
-	kb.updateCh <- &c
+	kb.updateCh <- contactUpdate{&c, nil}
+	<-kb.doneCh
+}
+
+// Update a contact and record the version and capabilities it announced.
+func (kb *KBuckets) UpdatePeer(c Contact, info PeerInfo) {
+	kb.updateCh <- contactUpdate{&c, &info}
+	<-kb.doneCh
+}
+
+// Return when a contact in the table was last heard from.
+func (kb *KBuckets) LastSeen(nodeId ID) (time.Time, bool) {
+	if entry := kb.table.find(kb.SelfId, nodeId); entry != nil {
+		return entry.seen, true
+	}
+	return time.Time{}, false
+}
+
+// Return what a contact announced in its last PING or PONG, if it is in the
+// table and announced anything.
+func (kb *KBuckets) PeerInfo(nodeId ID) (PeerInfo, bool) {
+	if entry := kb.table.find(kb.SelfId, nodeId); entry != nil && entry.info != nil {
+		return *entry.info, true
+	}
+	return PeerInfo{}, false
 }
 
 func (kb *KBuckets) Remove(nodeId ID) {
 	kb.removeCh <- nodeId
+	<-kb.doneCh
 }
 
-func (kb KBuckets) Find(nodeId ID) []Contact {
-	kb.closestCh <- nodeId
-	result := <-kb.closestResCh
-	return result
+func (kb *KBuckets) Find(nodeId ID) []Contact {
+	index := nodeId.Xor(kb.SelfId).PrefixLen()
+	l := make([]Contact, 0, kb.K)
+	kb.table.feedWithCLosest(&l, index, kb.K)
+	sortByDistance(l, nodeId)
+	return l
 }
 
-func (kb KBuckets) FindThree(nodeId ID) []Contact {
+func (kb *KBuckets) FindThree(nodeId ID) []Contact {
 	result := kb.Find(nodeId)
 	length := 3
 	if len(result) < 3 {
@@ -44,134 +110,289 @@ func (kb KBuckets) FindThree(nodeId ID) []Contact {
 }
 
 func (kb *KBuckets) FindOne(nodeId ID) (*Contact, error) {
-	kb.findCh <- nodeId
-	if result := <-kb.resCh; result != nil {
-		return result, nil
-	} else {
-		return nil, &NotFoundError{nodeId, "Not Found"}
+	if entry := kb.table.find(kb.SelfId, nodeId); entry != nil {
+		result := entry.contact
+		return &result, nil
+	}
+	return nil, &NotFoundError{nodeId, "Not Found"}
+}
+
+// Return a copy of every bucket, indexed by prefix length.
+func (kb *KBuckets) Buckets() [][]Contact {
+	buckets := make([][]Contact, b)
+	for i := 0; i < b; i++ {
+		entries := kb.table.bucket(i).entries
+		buckets[i] = make([]Contact, 0, len(entries))
+		for _, each := range entries {
+			buckets[i] = append(buckets[i], each.contact)
+		}
+	}
+	return buckets
+}
+
+// Return a copy of every replacement cache, indexed by prefix length.
+func (kb *KBuckets) Replacements() [][]Contact {
+	replacements := make([][]Contact, b)
+	for i := 0; i < b; i++ {
+		spare := kb.table.bucket(i).replacements
+		replacements[i] = make([]Contact, 0, len(spare))
+		for _, each := range spare {
+			replacements[i] = append(replacements[i], each.contact)
+		}
+	}
+	return replacements
+}
+
+// Return every contact in the routing table.
+func (kb *KBuckets) Contacts() []Contact {
+	result := make([]Contact, 0)
+	for _, bucket := range kb.Buckets() {
+		result = append(result, bucket...)
 	}
+	return result
 }
 
 // =======================================================
 
 func BuildKBuckets(self Contact) *KBuckets {
+	return NewKBuckets(self, k, KBucketsOptions{})
+}
+
+// What a routing table uses besides its size. The zero value means no events,
+// no diversity limits, no bans, the system clock and plain pings.
+type KBucketsOptions struct {
+	Events     *Events
+	Limits     DiversityLimits
+	Reputation *Reputation
+	Clock      Clock
+	// Ping checks a contact is alive. It runs on the goroutine making
+	// changes, so it must not change the table itself.
+	Ping func(Contact) error
+}
+
+// Build a routing table holding up to size contacts per bucket.
+func NewKBuckets(self Contact, size int, opts KBucketsOptions) *KBuckets {
 	kbuckets := new(KBuckets)
 	kbuckets.SelfContact = self
 	kbuckets.SelfId = self.NodeID
-	for i := 0; i < b; i++ {
-		kbuckets.Lists[i] = list.New()
+	kbuckets.K = size
+	kbuckets.Events = opts.Events
+	kbuckets.Limits = opts.Limits
+	kbuckets.Reputation = opts.Reputation
+	kbuckets.Clock = opts.Clock
+	if kbuckets.Clock == nil {
+		kbuckets.Clock = SystemClock
+	}
+	kbuckets.ping = opts.Ping
+	if kbuckets.ping == nil {
+		kbuckets.ping = kbuckets.pingDirect
+	}
+	for i := range kbuckets.table.buckets {
+		kbuckets.table.buckets[i].Store(new(tableBucket))
 	}
-	kbuckets.updateCh = make(chan *Contact)
+	kbuckets.updateCh = make(chan contactUpdate)
 	kbuckets.removeCh = make(chan ID)
-	kbuckets.findCh = make(chan ID)
-	kbuckets.resCh = make(chan *Contact)
-	kbuckets.closestCh = make(chan ID)
-	kbuckets.closestResCh = make(chan []Contact)
+	kbuckets.doneCh = make(chan bool)
 	go kbuckets.handleContact()
 	return kbuckets
 }
 
-func (kb KBuckets) find_contact(nodeId ID) (*Contact, error) {
-	ele, err := kb.find_element(nodeId)
-	if ele != nil {
-		return ele.Value.(*Contact), err
-	} else {
-		return nil, err
+// Ping c from any local address, for tables not owned by a Kademlia.
+func (kb *KBuckets) pingDirect(c Contact) error {
+	_, err := pingAddresses(kb.SelfContact, baseCapabilities, c.Addresses())
+	return err
+}
+
+func (t *routingTable) bucket(index int) *tableBucket {
+	return t.buckets[index].Load().(*tableBucket)
+}
+
+// Publish a new version of one bucket and its replacement cache.
+func (t *routingTable) set(index int, entries, spare []tableEntry) {
+	t.buckets[index].Store(&tableBucket{entries, spare})
+}
+
+func (t *routingTable) find(self, nodeId ID) *tableEntry {
+	index := nodeId.Xor(self).PrefixLen()
+	if index == b {
+		return nil
+	}
+	entries := t.bucket(index).entries
+	if i := indexOf(entries, nodeId); i >= 0 {
+		return &entries[i]
 	}
+	return nil
 }
 
-func (kb KBuckets) find_element(nodeId ID) (*list.Element, error) {
-	dis := nodeId.Xor(kb.SelfId)
-	index := dis.PrefixLen()
-	for each := kb.Lists[index].Front(); each != nil; each = each.Next() {
-		if nodeId == each.Value.(*Contact).NodeID {
-			return each, nil
+func indexOf(bucket []tableEntry, nodeId ID) int {
+	for i, each := range bucket {
+		if each.contact.NodeID == nodeId {
+			return i
 		}
 	}
-	return nil, &NotFoundError{nodeId, "Not Found"}
+	return -1
 }
 
-func (kb *KBuckets) add(index int, con *Contact) {
-	l := kb.Lists[index]
-	if l.Len() == k {
-		node := l.Front().Value.(*Contact)
-		if _, err := PingHelper(kb.SelfContact, node.Host, node.Port); err != nil {
-			l.Remove(l.Front())
-			l.PushBack(con)
-		} else {
-			l.MoveToBack(l.Front())
+// A new bucket holding the entries of bucket except the one at i, with room
+// for one more. Pass -1 to copy every entry.
+func without(bucket []tableEntry, i int) []tableEntry {
+	result := make([]tableEntry, 0, len(bucket)+1)
+	for j, each := range bucket {
+		if j != i {
+			result = append(result, each)
 		}
-	} else {
-		l.PushBack(con)
 	}
+	return result
+}
+
+// Add entry to the back of a replacement cache, dropping the least recently
+// seen replacement if the cache is full.
+func (kb *KBuckets) spare(spare []tableEntry, entry tableEntry) []tableEntry {
+	if len(spare) >= kb.K {
+		spare = spare[len(spare)-kb.K+1:]
+	}
+	return append(without(spare, -1), entry)
 }
 
-func (kb *KBuckets) update(index int, node *list.Element) {
-	l := kb.Lists[index]
-	l.MoveToBack(node)
+func (kb *KBuckets) update(u contactUpdate) {
+	index := u.contact.NodeID.Xor(kb.SelfId).PrefixLen()
+	if index == b {
+		return
+	}
+	t := &kb.table
+	bucket, spare := t.bucket(index).entries, t.bucket(index).replacements
+	if i := indexOf(bucket, u.contact.NodeID); i >= 0 {
+		// seen again, move it to the back
+		entry := bucket[i]
+		if u.info != nil {
+			entry.info = u.info
+		}
+		entry.seen = kb.Clock.Now()
+		t.set(index, append(without(bucket, i), entry), spare)
+		return
+	}
+	if kb.Reputation.Banned(*u.contact) {
+		return
+	}
+	entry := tableEntry{*u.contact, u.info, kb.Clock.Now()}
+	if i := indexOf(spare, u.contact.NodeID); i >= 0 {
+		if entry.info == nil {
+			entry.info = spare[i].info
+		}
+		spare = without(spare, i)
+	}
+	switch {
+	case !kb.Limits.allow(t, index, bucket, entry.contact):
+		t.set(index, bucket, kb.spare(spare, entry))
+	case len(bucket) < kb.K:
+		t.set(index, append(without(bucket, -1), entry), spare)
+		kb.Events.emit(Event{Kind: EventContactAdded, Contact: entry.contact})
+	default:
+		oldest := bucket[0]
+		if err := kb.ping(oldest.contact); err != nil {
+			t.set(index, append(without(bucket, 0), entry), spare)
+			kb.Events.emit(Event{Kind: EventContactRemoved, Contact: oldest.contact})
+			kb.Events.emit(Event{Kind: EventContactAdded, Contact: entry.contact})
+		} else {
+			// the oldest contact is alive, keep it and the new one as a replacement
+			t.set(index, append(without(bucket, 0), oldest), kb.spare(spare, entry))
+		}
+	}
 }
 
-func (kb *KBuckets) remove(index int, node *list.Element) {
-	l := kb.Lists[index]
-	l.Remove(node)
+func (kb *KBuckets) remove(nodeId ID) {
+	index := nodeId.Xor(kb.SelfId).PrefixLen()
+	if index == b {
+		return
+	}
+	t := &kb.table
+	bucket, spare := t.bucket(index).entries, t.bucket(index).replacements
+	i := indexOf(bucket, nodeId)
+	if i < 0 {
+		if j := indexOf(spare, nodeId); j >= 0 {
+			t.set(index, bucket, without(spare, j))
+		}
+		return
+	}
+	removed := bucket[i].contact
+	bucket = without(bucket, i)
+	var promoted *tableEntry
+	for j := len(spare) - 1; j >= 0; j-- {
+		if kb.Limits.allow(t, index, bucket, spare[j].contact) {
+			promoted = &spare[j]
+			bucket, spare = append(bucket, *promoted), without(spare, j)
+			break
+		}
+	}
+	t.set(index, bucket, spare)
+	kb.Events.emit(Event{Kind: EventContactRemoved, Contact: removed})
+	if promoted != nil {
+		kb.Events.emit(Event{Kind: EventContactAdded, Contact: promoted.contact})
+	}
 }
 
 func (kb *KBuckets) handleContact() {
 	for {
 		select {
-		case con := <-kb.updateCh:
-			index := con.NodeID.Xor(kb.SelfId).PrefixLen()
-			if index == 160 {
-				continue
-			}
-			if ele, err := kb.find_element(con.NodeID); err != nil {
-				kb.add(index, con)
-			} else {
-				kb.update(index, ele)
-			}
+		case u := <-kb.updateCh:
+			kb.update(u)
 		case nodeId := <-kb.removeCh:
-			index := nodeId.Xor(kb.SelfId).PrefixLen()
-			if ele, err := kb.find_element(nodeId); err == nil {
-				kb.remove(index, ele)
-			}
-		case nodeId := <-kb.findCh:
-			if result, err := kb.find_contact(nodeId); err != nil {
-				kb.resCh <- nil
-			} else {
-				kb.resCh <- result
-			}
-		case nodeId := <-kb.closestCh:
-			index := nodeId.Xor(kb.SelfId).PrefixLen()
-			l := make([]Contact, 0, k)
-			kb.feedWithCLosest(&l, index, nodeId)
-			sort.Stable(ContactArray{l, nodeId})
-			kb.closestResCh <- l
+			kb.remove(nodeId)
 		}
+		kb.doneCh <- true
 	}
 }
 
-func (kb *KBuckets) feedWithCLosest(s *[]Contact, index int, nodeId ID) {
+func (t *routingTable) feedWithCLosest(s *[]Contact, index int, size int) {
 	for i := index; i < b; i++ {
-		copy2array(s, kb.Lists[i], nodeId)
-		if len(*s) == k {
+		copy2array(s, t.bucket(i).entries, size)
+		if len(*s) == size {
 			return
 		}
 	}
 	for i := index - 1; i >= 0; i-- {
-		copy2array(s, kb.Lists[i], nodeId)
-		if len(*s) == k {
+		copy2array(s, t.bucket(i).entries, size)
+		if len(*s) == size {
 			return
 		}
 	}
 }
 
-func copy2array(s *[]Contact, l *list.List, nodeId ID) {
-	for each := l.Front(); each != nil; each = each.Next() {
-		if len(*s) == k {
+func copy2array(s *[]Contact, bucket []tableEntry, size int) {
+	for _, each := range bucket {
+		if len(*s) == size {
 			break
 		}
-		*s = append(*s, *each.Value.(*Contact))
+		*s = append(*s, each.contact)
+	}
+}
+
+// Stable sort of contacts by distance to id, working out each distance once
+// instead of on every comparison as ContactArray does.
+func sortByDistance(contacts []Contact, id ID) {
+	prefix := make([]int, len(contacts))
+	for i, each := range contacts {
+		prefix[i] = each.NodeID.Xor(id).PrefixLen()
 	}
+	sort.Stable(byDistance{contacts, prefix})
+}
+
+type byDistance struct {
+	contacts []Contact
+	prefix   []int
+}
+
+func (d byDistance) Len() int {
+	return len(d.contacts)
+}
+
+func (d byDistance) Swap(i, j int) {
+	d.contacts[i], d.contacts[j] = d.contacts[j], d.contacts[i]
+	d.prefix[i], d.prefix[j] = d.prefix[j], d.prefix[i]
+}
+
+func (d byDistance) Less(i, j int) bool {
+	return d.prefix[i] > d.prefix[j]
 }
 
 type ContactArray struct {
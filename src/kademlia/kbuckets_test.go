@@ -2,6 +2,7 @@ package kademlia
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"testing"
@@ -9,11 +10,11 @@ import (
 
 func Test_Remove(t *testing.T) {
 	self := NewRandomID()
-	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000})
+	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil})
 
 	// add remote Contact to the address book
 	remoteID := NewRandomID()
-	AddrBook.Update(Contact{remoteID, net.IPv4(127, 0, 0, 1), 7809})
+	AddrBook.Update(Contact{remoteID, net.IPv4(127, 0, 0, 1), 7809, nil})
 	if C, err := AddrBook.FindOne(remoteID); err == nil {
 		if !C.NodeID.Equals(remoteID) {
 			t.Error("Return ID not match.")
@@ -29,11 +30,11 @@ func Test_Remove(t *testing.T) {
 
 func Test_FindOne(t *testing.T) {
 	self := NewRandomID()
-	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000})
+	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil})
 
 	// add remote Contact to the address book
 	remoteID := NewRandomID()
-	AddrBook.Update(Contact{remoteID, net.IPv4(127, 0, 0, 1), 7809})
+	AddrBook.Update(Contact{remoteID, net.IPv4(127, 0, 0, 1), 7809, nil})
 	if C, err := AddrBook.FindOne(remoteID); err == nil {
 		if !C.NodeID.Equals(remoteID) {
 			t.Error("Return ID not match.")
@@ -50,17 +51,17 @@ func Test_FindOne(t *testing.T) {
 
 func Test_FindWithMoreThanK(t *testing.T) {
 	self := NewRandomID()
-	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000})
+	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil})
 
 	start := 7002
 	end := start + 50
 	for i := start; i <= end; i++ {
 		id := NewRandomID()
-		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i)})
+		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i), nil})
 	}
 
 	idForTest := NewRandomID()
-	AddrBook.Update(Contact{idForTest, net.IPv4(127, 0, 0, 1), uint16(7001)})
+	AddrBook.Update(Contact{idForTest, net.IPv4(127, 0, 0, 1), uint16(7001), nil})
 
 	if result := AddrBook.Find(idForTest); result == nil {
 		t.Error("Return nothing.")
@@ -79,17 +80,17 @@ func Test_FindWithMoreThanK(t *testing.T) {
 
 func Test_FindWithLessThanK(t *testing.T) {
 	self := NewRandomID()
-	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000})
+	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil})
 
 	idForTest := NewRandomID()
-	AddrBook.Update(Contact{idForTest, net.IPv4(127, 0, 0, 1), uint16(7001)})
+	AddrBook.Update(Contact{idForTest, net.IPv4(127, 0, 0, 1), uint16(7001), nil})
 
 	count := 10
 	start := 7002
 	end := start + count
 	for i := start; i < end; i++ {
 		id := NewRandomID()
-		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i)})
+		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i), nil})
 	}
 
 	if result := AddrBook.Find(idForTest); result == nil {
@@ -118,12 +119,12 @@ func Test_FindWithLessThanK(t *testing.T) {
 
 func Test_FindThree(t *testing.T) {
 	self := NewRandomID()
-	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000})
+	AddrBook := BuildKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil})
 	start := 7002
 	end := start + 10
 	for i := start; i < end; i++ {
 		id := NewRandomID()
-		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i)})
+		AddrBook.Update(Contact{id, net.IPv4(127, 0, 0, 1), uint16(i), nil})
 	}
 
 	if result := AddrBook.FindThree(NewRandomID()); result == nil {
@@ -152,3 +153,136 @@ func Test_LocalData(t *testing.T) {
 		t.Error("Not exist key found")
 	}
 }
+
+func Test_DiversityLimits(t *testing.T) {
+	self := NewRandomID()
+	kb := NewKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil}, k,
+		KBucketsOptions{Limits: DiversityLimits{BucketIP: 2}})
+	same := make([]Contact, 3)
+	for i := range same {
+		same[i] = Contact{RandomIDInBucket(self, 0), net.IPv4(10, 0, 0, 1), uint16(7100 + i), nil}
+		kb.Update(same[i])
+	}
+	other := Contact{RandomIDInBucket(self, 0), net.IPv4(10, 0, 1, 1), 7100, nil}
+	kb.Update(other)
+	assertIntEqual(3, len(kb.Buckets()[0]), "IP limit not applied to the bucket", t)
+	assertIntEqual(1, len(kb.Replacements()[0]), "Contact over the limit not kept as replacement", t)
+	_, err := kb.FindOne(same[2].NodeID)
+	assertTrue(err != nil, "Contact over the limit in the bucket", t)
+
+	kb.Remove(same[0].NodeID)
+	_, err = kb.FindOne(same[2].NodeID)
+	assertTrue(err == nil, "Replacement not promoted", t)
+	assertIntEqual(0, len(kb.Replacements()[0]), "Promoted contact still a replacement", t)
+
+	kb = NewKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil}, k,
+		KBucketsOptions{Limits: DiversityLimits{TableSubnet: 1}})
+	kb.Update(Contact{RandomIDInBucket(self, 0), net.IPv4(10, 0, 0, 1), 7100, nil})
+	kb.Update(Contact{RandomIDInBucket(self, 1), net.IPv4(10, 0, 0, 2), 7100, nil})
+	kb.Update(Contact{RandomIDInBucket(self, 1), net.IPv4(10, 0, 1, 1), 7100, nil})
+	kb.Update(Contact{RandomIDInBucket(self, 2), net.ParseIP("2001:db8:1::1"), 7100, nil})
+	kb.Update(Contact{RandomIDInBucket(self, 2), net.ParseIP("2001:db8:1:2::1"), 7100, nil})
+	assertIntEqual(3, len(kb.Contacts()), "Subnet limit not applied to the table", t)
+	assertIntEqual(1, len(kb.Replacements()[1]), "IPv4 subnet over the limit not kept", t)
+	assertIntEqual(1, len(kb.Replacements()[2]), "IPv6 subnet over the limit not kept", t)
+}
+
+// A full bucket checks its oldest contact through the configured ping, and
+// evicts it only if the ping fails.
+func Test_EvictionPing(t *testing.T) {
+	self := NewRandomID()
+	pinged := make([]ID, 0)
+	alive := true
+	kb := NewKBuckets(Contact{self, net.IPv4(127, 0, 0, 1), 7000, nil}, 2,
+		KBucketsOptions{Ping: func(c Contact) error {
+			pinged = append(pinged, c.NodeID)
+			if alive {
+				return nil
+			}
+			return errors.New("no answer")
+		}})
+	contacts := make([]Contact, 4)
+	for i := range contacts {
+		contacts[i] = Contact{RandomIDInBucket(self, 0), net.IPv4(10, 0, 0, 1), uint16(7100 + i), nil}
+	}
+	kb.Update(contacts[0])
+	kb.Update(contacts[1])
+	kb.Update(contacts[2])
+	assertIntEqual(1, len(pinged), "Oldest contact not pinged", t)
+	assertTrue(pinged[0].Equals(contacts[0].NodeID), "Wrong contact pinged", t)
+	_, err := kb.FindOne(contacts[0].NodeID)
+	assertTrue(err == nil, "Live contact evicted", t)
+	assertIntEqual(1, len(kb.Replacements()[0]), "New contact not kept as replacement", t)
+
+	alive = false
+	kb.Update(contacts[3])
+	assertTrue(pinged[1].Equals(contacts[1].NodeID), "Wrong contact pinged", t)
+	_, err = kb.FindOne(contacts[1].NodeID)
+	assertTrue(err != nil, "Dead contact kept", t)
+	_, err = kb.FindOne(contacts[3].NodeID)
+	assertTrue(err == nil, "New contact not added", t)
+}
+
+// ======================= Benchmarks ===========================
+// A table with a few hundred contacts on ports nothing listens on, so full
+// buckets evict without waiting for a ping.
+func benchmarkTable() (*KBuckets, []Contact) {
+	kb := BuildKBuckets(Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil})
+	for i := 0; i < 300; i++ {
+		kb.Update(Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), uint16(7100 + i), nil})
+	}
+	return kb, kb.Contacts()
+}
+
+func benchmarkTargets(n int) []ID {
+	targets := make([]ID, n)
+	for i := range targets {
+		targets[i] = NewRandomID()
+	}
+	return targets
+}
+
+func Benchmark_FindParallel(b *testing.B) {
+	kb, _ := benchmarkTable()
+	targets := benchmarkTargets(1024)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			kb.Find(targets[i%len(targets)])
+		}
+	})
+}
+
+// Lookups mixed with contact refreshes, one in ten operations, as when
+// incoming RPCs update the table.
+func Benchmark_FindWhileUpdating(b *testing.B) {
+	kb, contacts := benchmarkTable()
+	targets := benchmarkTargets(1024)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				kb.Update(contacts[i%len(contacts)])
+			} else {
+				kb.Find(targets[i%len(targets)])
+			}
+		}
+	})
+}
+
+// FIND_NODE requests served concurrently by the handler, without the network.
+func Benchmark_FindNodeHandler(b *testing.B) {
+	kc := &KademliaCore{instance[8], nil}
+	sender := instance[9].SelfContact
+	targets := benchmarkTargets(1024)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var res FindNodeResult
+		for i := 0; pb.Next(); i++ {
+			req := FindNodeRequest{sender, NewRandomID(), targets[i%len(targets)], NewEnvelope()}
+			if err := kc.FindNode(req, &res); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package kademlia
+
+// Contains the procedure a node runs before shutting down. Every value it
+// holds for the network is pushed to the current closest nodes that do not
+// hold it for good, so leaving costs no replicas, and then every contact in the
+// routing table is told to drop the node rather than finding out through
+// timeouts. Cached copies are not handed off; they expire anyway.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type LeaveReport struct {
+	Handoff    []BulkResult // one per value handed off, Replicas counts holders
+	Notified   int          // contacts that acknowledged the LEAVE
+	Neighbours int          // contacts sent a LEAVE
+}
+
+// Hand off the values held and tell the neighbours the node is leaving. The
+// node keeps serving; the caller shuts it down afterwards.
+func (k *Kademlia) Leave() LeaveReport {
+	records := make([]BulkRecord, 0)
+	for _, info := range k.LocalKeys() {
+		if info.Origin.Kind == OriginCache {
+			continue
+		}
+		if value, _, ok := k.LocalData.Peek(info.Key); ok {
+			records = append(records, BulkRecord{Key: info.Key, Value: value})
+		}
+	}
+	report := LeaveReport{Handoff: runBulk(k.Clock, records, bulkParallelism, 1, k.handOff)}
+	neighbours := k.AddrBook.Contacts()
+	report.Neighbours = len(neighbours)
+	report.Notified = k.notifyLeave(neighbours)
+	return report
+}
+
+// Store r on the closest nodes to its key that do not hold it yet, or only
+// hold a cached copy. Returns the number of nodes holding it afterwards.
+func (k *Kademlia) handOff(r BulkRecord) (int, error) {
+	held := 0
+	missing := make([]Contact, 0)
+	for _, each := range k.iterativeFindNode(r.Key) {
+		if each.NodeID == k.NodeID {
+			continue
+		}
+		if res, _, err := k.findValue(&each, r.Key); err == nil && res.Value != nil && !res.Cached {
+			held++
+		} else {
+			missing = append(missing, each)
+		}
+	}
+	held += len(k.storeOn(missing, r.Key, r.Value))
+	if held == 0 {
+		return 0, errors.New("no node accepted the value")
+	}
+	return held, nil
+}
+
+// Send a LEAVE to every contact at once and return how many acknowledged it.
+func (k *Kademlia) notifyLeave(contacts []Contact) int {
+	notified := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range contacts {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if k.sendLeave(c) == nil {
+				mu.Lock()
+				notified++
+				mu.Unlock()
+			}
+		}(contacts[i])
+	}
+	wg.Wait()
+	return notified
+}
+
+func (k *Kademlia) sendLeave(contact Contact) (err error) {
+	start := k.Clock.Now()
+	msgId := NewRandomID()
+	defer func() {
+		k.sentRPC("leave", start, err, F("peer", contact.NodeID), F("msgid", msgId))
+	}()
+	req := LeaveRequest{k.SelfContact, msgId, NewEnvelope()}
+	var res LeaveResult
+	// LEAVE is not part of the UDP codec
+	err = k.callAddresses(0, contact.Addresses(), "Leave", &msgId, req, &res)
+	if err == nil {
+		err = k.checkResponse(contact, msgId, res.MsgID)
+	}
+	if err == nil {
+		err = res.Err.Err()
+	}
+	return err
+}
+
+// ======================= CLI ===================
+func (k *Kademlia) DoLeave() string {
+	report := k.Leave()
+	failed := 0
+	lines := make([]string, 0)
+	for _, each := range report.Handoff {
+		if each.Err != nil {
+			failed++
+			lines = append(lines, each.Record.Key.AsString()+" err="+each.Err.Error())
+		}
+	}
+	summary := fmt.Sprintf("OK: Handed off %d keys, %d of %d neighbours notified",
+		len(report.Handoff), report.Notified, report.Neighbours)
+	if failed > 0 {
+		summary = fmt.Sprintf("ERR: %d of %d keys not handed off, %d of %d neighbours notified",
+			failed, len(report.Handoff), report.Notified, report.Neighbours)
+	}
+	return strings.Join(append([]string{summary}, lines...), "\n")
+}
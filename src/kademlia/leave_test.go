@@ -0,0 +1,80 @@
+package kademlia
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LeaveHandsOffData(t *testing.T) {
+	k := NewKademliaWithConfig("localhost:7978", DefaultConfig())
+	peer := instance[3].SelfContact
+	k.DoPing(peer.Host, peer.Port)
+	k.iterativeFindNode(k.NodeID)
+	key := NewRandomID()
+	k.addData(Pair{key, []byte("handed off")})
+	k.addDataFrom(Pair{NewRandomID(), []byte("cached")}, ValueOrigin{Kind: OriginCache}, time.Now())
+
+	report := k.Leave()
+	assertIntEqual(1, len(report.Handoff), "Cached copy handed off or value skipped", t)
+	assertTrue(report.Handoff[0].Err == nil, "Value not handed off", t)
+	assertTrue(report.Neighbours > 0, "No neighbours notified", t)
+	assertIntEqual(report.Neighbours, report.Notified, "Neighbour did not acknowledge", t)
+
+	_, err := instance[3].AddrBook.FindOne(k.NodeID)
+	assertTrue(err != nil, "Leaving node kept in routing table", t)
+	_, value := instance[4].iterativeFindValue(key)
+	assertStringEqual("handed off", string(value), "Value lost after leave", t)
+	assertTrue(strings.HasPrefix(k.DoLeave(), "OK:"), "Second leave failed", t)
+}
+
+// A LEAVE naming a contact only removes it when sent from the contact's own
+// address.
+func Test_LeaveFromOtherAddress(t *testing.T) {
+	k := NewKademlia("localhost:7997")
+	c := Contact{NewRandomID(), net.IPv4(10, 0, 0, 12), 7100, nil}
+	k.AddrBook.Update(c)
+	leave := func(source net.IP) {
+		req := LeaveRequest{c, NewRandomID(), NewEnvelope()}
+		var res LeaveResult
+		(&KademliaCore{k, source}).Leave(req, &res)
+	}
+	leave(net.IPv4(10, 0, 0, 13))
+	_, err := k.AddrBook.FindOne(c.NodeID)
+	assertTrue(err == nil, "Contact removed by a LEAVE from another address", t)
+	leave(nil)
+	_, err = k.AddrBook.FindOne(c.NodeID)
+	assertTrue(err == nil, "Contact removed by a LEAVE from an unknown address", t)
+	leave(c.Host)
+	_, err = k.AddrBook.FindOne(c.NodeID)
+	assertTrue(err != nil, "Contact kept after its own LEAVE", t)
+}
+
+/*
+ * A neighbour holding only a cached copy would lose the value once it
+ * expires, so it gets a permanent copy as well.
+ */
+func Test_LeaveReplacesCachedCopies(t *testing.T) {
+	k := NewKademliaWithConfig("localhost:7991", DefaultConfig())
+	peer := instance[6].SelfContact
+	k.DoPing(peer.Host, peer.Port)
+	key := NewRandomID()
+	k.addData(Pair{key, []byte("held for good")})
+	var closest *Kademlia
+	for _, each := range k.iterativeFindNode(key) {
+		if i := int(each.Port) - 7890; i >= 0 && i < len(instance) {
+			instance[i].addDataFrom(Pair{key, []byte("held for good")}, ValueOrigin{Kind: OriginCache}, time.Now())
+			if closest == nil {
+				closest = instance[i]
+			}
+		}
+	}
+	assertTrue(closest != nil, "No neighbour to cache at", t)
+
+	report := k.Leave()
+	assertTrue(report.Handoff[0].Err == nil, "Value not handed off", t)
+	_, info, ok := closest.LocalData.Peek(key)
+	assertTrue(ok, "Value lost", t)
+	assertTrue(info.Expires.IsZero(), "Closest neighbour still holds only a cached copy", t)
+}
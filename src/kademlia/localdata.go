@@ -0,0 +1,219 @@
+package kademlia
+
+// Contains inspection of the values held by a node and the archive format
+// used to export them and import them into another node. Archives are JSON
+// so they can be read and edited by hand; values and ciphertexts are base64.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Origins of a locally held value.
+const (
+	OriginLocal  = "local"  // added by this node
+	OriginStore  = "store"  // STORE from another node
+	OriginCache  = "cache"  // cached after an iterativeFindValue
+	OriginImport = "import" // loaded from an archive
+)
+
+type ValueOrigin struct {
+	Kind   string
+	NodeID ID // sender of a STORE, or node an archive was exported from
+}
+
+type ValueInfo struct {
+	Key     ID
+	Size    int
+	Stored  time.Time
+	Origin  ValueOrigin
+	Expires time.Time // zero unless the value is a cached copy
+}
+
+// List every locally held value, sorted by key.
+func (k *Kademlia) LocalKeys() []ValueInfo {
+	infos := k.LocalData.List()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key.Less(infos[j].Key)
+	})
+	return infos
+}
+
+func (k *Kademlia) localVdos() []VdoPair {
+	k.listVdoChan <- true
+	return <-k.listVdoRes
+}
+
+// ======================= Archives ===================
+const archiveVersion = 1
+
+type Archive struct {
+	Version  int            `json:"version"`
+	NodeID   string         `json:"node_id"`
+	Exported time.Time      `json:"exported"`
+	Values   []ArchiveValue `json:"values"`
+	Vdos     []ArchiveVdo   `json:"vdos"`
+}
+
+type ArchiveValue struct {
+	Key     string     `json:"key"`
+	Value   []byte     `json:"value"`
+	Stored  time.Time  `json:"stored"`
+	Origin  string     `json:"origin"`
+	From    string     `json:"from,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"` // cached copies only
+}
+
+type ArchiveVdo struct {
+	ID         string `json:"id"`
+	AccessKey  int64  `json:"access_key"`
+	Ciphertext []byte `json:"ciphertext"`
+	NumberKeys byte   `json:"number_keys"`
+	Threshold  byte   `json:"threshold"`
+	Timeout    byte   `json:"timeout"`
+}
+
+// Write every local value and VDO to w.
+func (k *Kademlia) ExportData(w io.Writer) error {
+	archive := Archive{Version: archiveVersion, NodeID: k.NodeID.AsString(), Exported: k.Clock.Now()}
+	archive.Values = make([]ArchiveValue, 0)
+	for _, info := range k.LocalKeys() {
+		value, _, ok := k.LocalData.Peek(info.Key)
+		if !ok {
+			continue
+		}
+		each := ArchiveValue{info.Key.AsString(), value, info.Stored, info.Origin.Kind, "", nil}
+		if info.Origin.NodeID != (ID{}) {
+			each.From = info.Origin.NodeID.AsString()
+		}
+		if !info.Expires.IsZero() {
+			expires := info.Expires
+			each.Expires = &expires
+		}
+		archive.Values = append(archive.Values, each)
+	}
+	archive.Vdos = make([]ArchiveVdo, 0)
+	for _, pair := range k.localVdos() {
+		vdo := pair.vdo
+		archive.Vdos = append(archive.Vdos, ArchiveVdo{pair.key.AsString(), vdo.AccessKey,
+			vdo.Ciphertext, vdo.NumberKeys, vdo.Threshold, vdo.Timeout})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(archive)
+}
+
+// Load an archive written by ExportData. Values keep their original store
+// time and are marked as imported from the exporting node. Cached copies stay
+// cached until they expire, those already expired are skipped. Imported VDOs
+// are not refreshed; the node that created them keeps doing that.
+func (k *Kademlia) ImportData(r io.Reader) (values int, vdos int, err error) {
+	var archive Archive
+	if err = json.NewDecoder(r).Decode(&archive); err != nil {
+		return 0, 0, err
+	}
+	if archive.Version != archiveVersion {
+		return 0, 0, errors.New("unsupported archive version")
+	}
+	from, err := IDFromString(archive.NodeID)
+	if err != nil {
+		return 0, 0, errors.New("invalid node_id in archive")
+	}
+	// check everything before importing anything
+	keys := make([]ID, len(archive.Values))
+	for i, each := range archive.Values {
+		if keys[i], err = IDFromString(each.Key); err != nil {
+			return 0, 0, errors.New("invalid key " + each.Key)
+		}
+	}
+	ids := make([]ID, len(archive.Vdos))
+	for i, each := range archive.Vdos {
+		if ids[i], err = IDFromString(each.ID); err != nil {
+			return 0, 0, errors.New("invalid VDO id " + each.ID)
+		}
+	}
+	now := k.Clock.Now()
+	for i, each := range archive.Values {
+		pair := Pair{keys[i], each.Value}
+		if each.Origin != OriginCache && each.Expires == nil {
+			k.addDataFrom(pair, ValueOrigin{OriginImport, from}, each.Stored)
+			values++
+			continue
+		}
+		// archives from before expiries were written get the full TTL
+		expires := each.Stored.Add(k.Config.CacheTTL)
+		if each.Expires != nil {
+			expires = *each.Expires
+		}
+		if expires.After(now) {
+			k.addDataFor(pair, ValueOrigin{OriginCache, from}, each.Stored, expires.Sub(each.Stored))
+			values++
+		}
+	}
+	for i, each := range archive.Vdos {
+		vdo := VanashingDataObject{each.AccessKey, each.Ciphertext, each.NumberKeys, each.Threshold, each.Timeout}
+		k.addVdoData(VdoPair{ids[i], &vdo})
+	}
+	return values, len(archive.Vdos), nil
+}
+
+func (k *Kademlia) ExportFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = k.ExportData(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (k *Kademlia) ImportFile(path string) (values int, vdos int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return k.ImportData(f)
+}
+
+// ======================= CLI ===================
+func (k *Kademlia) DoLocalKeys() string {
+	infos := k.LocalKeys()
+	lines := []string{fmt.Sprintf("OK: %d keys", len(infos))}
+	now := k.Clock.Now()
+	for _, info := range infos {
+		line := fmt.Sprintf("%s size=%d age=%s origin=%s", info.Key.AsString(), info.Size,
+			now.Sub(info.Stored).Round(time.Second), info.Origin.Kind)
+		if info.Origin.NodeID != (ID{}) {
+			line += " from=" + info.Origin.NodeID.AsString()
+		}
+		if !info.Expires.IsZero() {
+			line += " expires=" + info.Expires.Sub(now).Round(time.Second).String()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (k *Kademlia) DoExport(path string) string {
+	if err := k.ExportFile(path); err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: Exported to " + path
+}
+
+func (k *Kademlia) DoImport(path string) string {
+	values, vdos, err := k.ImportFile(path)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return fmt.Sprintf("OK: Imported %d values and %d VDOs", values, vdos)
+}
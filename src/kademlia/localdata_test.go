@@ -0,0 +1,83 @@
+package kademlia
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LocalKeys(t *testing.T) {
+	k := NewKademlia("localhost:7972")
+	stored := NewRandomID()
+	instance[0].DoStore(&k.SelfContact, stored, []byte("from a peer"))
+	local := NewRandomID()
+	k.addData(Pair{local, []byte("mine")})
+
+	infos := k.LocalKeys()
+	assertIntEqual(2, len(infos), "Wrong number of local keys", t)
+	for _, info := range infos {
+		switch info.Key {
+		case stored:
+			assertStringEqual(OriginStore, info.Origin.Kind, "Wrong origin of stored value", t)
+			assertTrue(info.Origin.NodeID.Equals(instance[0].NodeID), "Wrong sender of stored value", t)
+			assertIntEqual(11, info.Size, "Wrong size of stored value", t)
+		case local:
+			assertStringEqual(OriginLocal, info.Origin.Kind, "Wrong origin of local value", t)
+		default:
+			t.Error("Unexpected key listed")
+		}
+	}
+	assertContains(k.DoLocalKeys(), "OK: 2 keys", "Wrong CLI listing", t)
+	assertContains(k.DoLocalKeys(), "from="+instance[0].NodeID.AsString(), "Sender not listed", t)
+}
+
+func Test_ExportImport(t *testing.T) {
+	k1 := NewKademlia("localhost:7973")
+	k2 := NewKademlia("localhost:7974")
+	key := NewRandomID()
+	k1.addData(Pair{key, []byte("backed up")})
+	vdoId := NewRandomID()
+	vdo := VanashingDataObject{42, []byte("ciphertext"), 5, 3, 1}
+	k1.addVdoData(VdoPair{vdoId, &vdo})
+
+	var buf bytes.Buffer
+	assertTrue(k1.ExportData(&buf) == nil, "Export failed", t)
+	values, vdos, err := k2.ImportData(&buf)
+	assertTrue(err == nil, "Import failed", t)
+	assertIntEqual(1, values, "Wrong number of values imported", t)
+	assertIntEqual(1, vdos, "Wrong number of VDOs imported", t)
+
+	value, err := k2.getData(key)
+	assertTrue(err == nil && string(value) == "backed up", "Value not imported", t)
+	imported, err := k2.getVdoData(vdoId)
+	assertTrue(err == nil && imported.AccessKey == 42, "VDO not imported", t)
+	info := k2.LocalKeys()[0]
+	assertStringEqual(OriginImport, info.Origin.Kind, "Imported value has wrong origin", t)
+	assertTrue(info.Origin.NodeID.Equals(k1.NodeID), "Imported value has wrong source", t)
+
+	_, _, err = k2.ImportData(strings.NewReader(`{"version": 1, "node_id": "zz"}`))
+	assertTrue(err != nil, "Archive with invalid node ID accepted", t)
+}
+
+// Cached copies, hot key replicas among them, must stay cached across an
+// export and import rather than become values held for good.
+func Test_ImportKeepsCachedCopies(t *testing.T) {
+	k1 := NewKademlia("localhost:7995")
+	k2 := NewKademlia("localhost:7996")
+	cached := NewRandomID()
+	k1.addDataFor(Pair{cached, []byte("cached")}, ValueOrigin{Kind: OriginCache}, time.Now(), time.Minute)
+	expired := NewRandomID()
+	k1.addDataFor(Pair{expired, []byte("expired")}, ValueOrigin{Kind: OriginCache}, time.Now().Add(-time.Hour), time.Minute)
+
+	var buf bytes.Buffer
+	assertTrue(k1.ExportData(&buf) == nil, "Export failed", t)
+	values, _, err := k2.ImportData(&buf)
+	assertTrue(err == nil, "Import failed", t)
+	assertIntEqual(1, values, "Expired copy imported", t)
+	_, info, ok := k2.LocalData.Peek(cached)
+	assertTrue(ok, "Cached copy not imported", t)
+	assertStringEqual(OriginCache, info.Origin.Kind, "Cached copy imported for good", t)
+	_, want, _ := k1.LocalData.Peek(cached)
+	assertTrue(info.Expires.Equal(want.Expires), "Cached copy got a new expiry", t)
+}
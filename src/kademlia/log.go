@@ -0,0 +1,160 @@
+package kademlia
+
+// Contains the leveled, structured logger used by a node. Nodes are quiet by
+// default so that the CLI output on stdout stays parseable; main turns logging
+// on with flags and can send it to a file as text or JSON.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "off"
+}
+
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelOff, errors.New("unknown log level " + s)
+}
+
+// A structured key/value attached to a log line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// A Logger that discards everything, the default for new nodes.
+type QuietLogger struct{}
+
+func (QuietLogger) Debug(msg string, fields ...Field) {}
+func (QuietLogger) Info(msg string, fields ...Field)  {}
+func (QuietLogger) Warn(msg string, fields ...Field)  {}
+func (QuietLogger) Error(msg string, fields ...Field) {}
+
+// Writes lines at or above a level, either as logfmt-style text or as one
+// JSON object per line.
+type WriterLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+func NewLogger(out io.Writer, level Level, asJSON bool) *WriterLogger {
+	return &WriterLogger{out: out, level: level, json: asJSON}
+}
+
+// Open (or append to) a log file and log to it.
+func NewFileLogger(path string, level Level, asJSON bool) (*WriterLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(f, level, asJSON), nil
+}
+
+func (l *WriterLogger) Debug(msg string, fields ...Field) { l.write(LevelDebug, msg, fields) }
+func (l *WriterLogger) Info(msg string, fields ...Field)  { l.write(LevelInfo, msg, fields) }
+func (l *WriterLogger) Warn(msg string, fields ...Field)  { l.write(LevelWarn, msg, fields) }
+func (l *WriterLogger) Error(msg string, fields ...Field) { l.write(LevelError, msg, fields) }
+
+func (l *WriterLogger) write(level Level, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	now := time.Now().Format(time.RFC3339Nano)
+	var line string
+	if l.json {
+		line = jsonLine(now, level, msg, fields)
+	} else {
+		line = textLine(now, level, msg, fields)
+	}
+	l.mu.Lock()
+	io.WriteString(l.out, line)
+	l.mu.Unlock()
+}
+
+func textLine(now string, level Level, msg string, fields []Field) string {
+	parts := []string{now, strings.ToUpper(level.String()), msg}
+	for _, f := range fields {
+		value := fieldString(f.Value)
+		if strings.ContainsAny(value, " \t\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		parts = append(parts, f.Key+"="+value)
+	}
+	return strings.Join(parts, " ") + "\n"
+}
+
+func jsonLine(now string, level Level, msg string, fields []Field) string {
+	obj := map[string]interface{}{"time": now, "level": level.String(), "msg": msg}
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case bool, int, int64, uint16, float64:
+			obj[f.Key] = v
+		default:
+			obj[f.Key] = fieldString(v)
+		}
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Sprintf("{\"msg\":%q}\n", msg)
+	}
+	return string(data) + "\n"
+}
+
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case ID:
+		return v.AsString()
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
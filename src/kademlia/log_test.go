@@ -0,0 +1,32 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_LoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelWarn, false)
+	logger.Info("hidden")
+	logger.Warn("shown", F("rpc", "store"), F("err", "bad thing"))
+	out := buf.String()
+	assertNotContains(out, "hidden", "Line below level written", t)
+	assertContains(out, "WARN shown rpc=store err=\"bad thing\"", "Text line malformed", t)
+}
+
+func Test_LoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelDebug, true)
+	peer := NewRandomID()
+	logger.Debug("rpc sent", F("peer", peer), F("hops", 3))
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &line); err != nil {
+		t.Fatal(err)
+	}
+	assertStringEqual("debug", line["level"].(string), "Wrong level", t)
+	assertStringEqual(peer.AsString(), line["peer"].(string), "Peer ID not logged as hex", t)
+	assertTrue(line["hops"].(float64) == 3, "Integer field not kept as number", t)
+}
@@ -0,0 +1,241 @@
+package kademlia
+
+// Contains the node's metrics: RPC counters and latencies, lookup hop counts
+// and timeouts, plus routing table and storage gauges read at scrape time.
+// Everything is written in the Prometheus text format.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Served next to the RPC endpoint, suffixed with the port the same way.
+const MetricsPath = "/debug/metrics"
+
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+var hopBuckets = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metricFamily struct {
+	help       string
+	kind       string
+	counters   map[string]uint64
+	histograms map[string]*histogram
+}
+
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+
+	vdoRefreshes int64
+}
+
+func NewMetrics() *Metrics {
+	m := new(Metrics)
+	m.families = make(map[string]*metricFamily)
+	return m
+}
+
+func (m *Metrics) family(name, kind, help string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{help, kind, make(map[string]uint64), make(map[string]*histogram)}
+		m.families[name] = f
+	}
+	return f
+}
+
+func (m *Metrics) inc(name, help, labels string) {
+	m.mu.Lock()
+	m.family(name, "counter", help).counters[labels]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observe(name, help, labels string, bounds []float64, v float64) {
+	m.mu.Lock()
+	f := m.family(name, "histogram", help)
+	h, ok := f.histograms[labels]
+	if !ok {
+		h = &histogram{bounds, make([]uint64, len(bounds)), 0, 0}
+		f.histograms[labels] = h
+	}
+	h.observe(v)
+	m.mu.Unlock()
+}
+
+// ======================= Recording ===================
+func (m *Metrics) rpc(name, direction string, took time.Duration, ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	m.inc("kademlia_rpc_total", "RPCs sent and received.",
+		fmt.Sprintf(`rpc="%s",direction="%s",result="%s"`, name, direction, result))
+	m.observe("kademlia_rpc_duration_seconds", "RPC latency.",
+		fmt.Sprintf(`rpc="%s",direction="%s"`, name, direction),
+		latencyBuckets, took.Seconds())
+}
+
+func (m *Metrics) RPCSent(name string, took time.Duration, err error) {
+	m.rpc(name, "sent", took, err == nil)
+}
+
+func (m *Metrics) RPCReceived(name string, took time.Duration, err error) {
+	m.rpc(name, "received", took, err == nil)
+}
+
+func (m *Metrics) LookupDone(name string, hops int) {
+	m.observe("kademlia_lookup_hops", "Rounds taken by iterative lookups.",
+		fmt.Sprintf(`lookup="%s"`, name), hopBuckets, float64(hops))
+}
+
+func (m *Metrics) LookupTimeout(name string) {
+	m.inc("kademlia_lookup_timeouts_total", "Contacts that timed out during iterative lookups.",
+		fmt.Sprintf(`lookup="%s"`, name))
+}
+
+// Count a request sent over UDP, and whether it had to be retried over TCP.
+func (m *Metrics) UDPRequest(method string, fellBack bool) {
+	result := "ok"
+	if fellBack {
+		result = "fallback"
+	}
+	m.inc("kademlia_udp_requests_total", "Requests sent over UDP.",
+		fmt.Sprintf(`method="%s",result="%s"`, method, result))
+}
+
+func (m *Metrics) VdoRefreshStarted() {
+	atomic.AddInt64(&m.vdoRefreshes, 1)
+}
+
+func (m *Metrics) VdoRefreshStopped() {
+	atomic.AddInt64(&m.vdoRefreshes, -1)
+}
+
+// ======================= Exposition ===================
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		for _, labels := range sortedKeys(f.counters) {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels, f.counters[labels])
+		}
+		labelSets := make([]string, 0, len(f.histograms))
+		for labels := range f.histograms {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			h := f.histograms[labels]
+			for i, bound := range h.bounds {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+		}
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range sortedKeys(values) {
+		if labels == "" {
+			fmt.Fprintf(w, "%s %d\n", name, values[labels])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels, values[labels])
+		}
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch m := m.(type) {
+	case map[string]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write every metric of the node, including gauges read from the routing
+// table and local storage.
+func (k *Kademlia) WriteMetrics(w io.Writer) {
+	k.Metrics.WriteText(w)
+
+	occupancy := make(map[string]int64)
+	total := int64(0)
+	for i, bucket := range k.AddrBook.Buckets() {
+		if len(bucket) > 0 {
+			occupancy[fmt.Sprintf(`bucket="%d"`, i)] = int64(len(bucket))
+			total += int64(len(bucket))
+		}
+	}
+	writeGauge(w, "kademlia_bucket_contacts", "Contacts in each non-empty bucket.", occupancy)
+	writeGauge(w, "kademlia_routing_table_contacts", "Contacts in the routing table.",
+		map[string]int64{"": total})
+	spare := int64(0)
+	for _, replacements := range k.AddrBook.Replacements() {
+		spare += int64(len(replacements))
+	}
+	writeGauge(w, "kademlia_replacement_contacts", "Contacts in the replacement caches.",
+		map[string]int64{"": spare})
+
+	keys, size := k.dataStats()
+	writeGauge(w, "kademlia_stored_keys", "Keys held in local storage.",
+		map[string]int64{"": int64(keys)})
+	writeGauge(w, "kademlia_stored_bytes", "Bytes of values held in local storage.",
+		map[string]int64{"": int64(size)})
+	hot, replicas := int64(0), int64(0)
+	for _, each := range k.Hot.List() {
+		hot++
+		replicas += int64(len(each.Replicas))
+	}
+	writeGauge(w, "kademlia_hot_keys", "Keys read often enough to be replicated further.",
+		map[string]int64{"": hot})
+	writeGauge(w, "kademlia_hot_replicas", "Extra copies of hot keys stored on other nodes.",
+		map[string]int64{"": replicas})
+	writeGauge(w, "kademlia_vdo_refreshes", "Live Vanish refresh goroutines.",
+		map[string]int64{"": atomic.LoadInt64(&k.Metrics.vdoRefreshes)})
+}
+
+func (k *Kademlia) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		k.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,48 @@
+package kademlia
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+	instance1 := instance[0]
+	instance2 := instance[1]
+	key := NewRandomID()
+	instance1.DoStore(&instance2.SelfContact, key, []byte("metrics"))
+	instance1.DoIterativeFindNode(NewRandomID())
+
+	port := strconv.Itoa(int(instance2.SelfContact.Port))
+	resp, err := http.Get("http://localhost:" + port + MetricsPath + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	text := string(body)
+	assertContains(text,
+		`kademlia_rpc_total{rpc="store",direction="received",result="ok"}`,
+		"Received store not counted", t)
+	assertContains(text,
+		`kademlia_rpc_duration_seconds_count{rpc="store",direction="received"}`,
+		"Received store latency not recorded", t)
+	assertContains(text, "# TYPE kademlia_stored_keys gauge", "Stored keys gauge missing", t)
+	assertContains(text, "kademlia_routing_table_contacts ", "Routing table gauge missing", t)
+
+	text = ""
+	port = strconv.Itoa(int(instance1.SelfContact.Port))
+	resp, err = http.Get("http://localhost:" + port + MetricsPath + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	text = string(body)
+	assertContains(text,
+		`kademlia_rpc_total{rpc="store",direction="sent",result="ok"}`,
+		"Sent store not counted", t)
+	assertContains(text, `kademlia_lookup_hops_count{lookup="find_node"}`,
+		"Lookup hops not recorded", t)
+}
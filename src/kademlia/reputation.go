@@ -0,0 +1,337 @@
+package kademlia
+
+// Contains the peer reputation tracker and ban list. Every violation costs
+// the peer some points and each good reply wins one back. A node ID or IP
+// that falls to the ban threshold is banned for Config.BanDuration: its
+// requests are refused and it is kept out of the routing table. Bans can also
+// be set and lifted by hand.
+//
+// Bad replies to our own requests count against the node ID and IP we
+// called. Bad requests only count against the address they came from, since
+// the sender a request names is not authenticated and anyone could name an
+// honest peer to get it banned. Timeouts only count against node IDs, since
+// many honest nodes may share an address that stops answering. A contact that
+// times out staleFailures times in a row is dropped from the routing table
+// without being banned. Loopback addresses are never banned automatically, so
+// local test networks keep working.
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for Config.BanThreshold and Config.BanDuration.
+const (
+	banThreshold = 50
+	banDuration  = time.Hour
+	// timeouts in a row after which a contact is dropped from the routing table
+	staleFailures = 3
+)
+
+// Points a peer loses for each kind of violation.
+var violationPenalty = map[Violation]int{
+	BadMsgID:        10,
+	BadVersion:      5,
+	BadTimestamp:    5,
+	ReplayedRequest: 10,
+	Timeout:         1,
+	InvalidRecord:   10,
+}
+
+// What is known about one node ID or IP.
+type PeerRecord struct {
+	Target      string // node ID in hex or IP
+	Score       int    // zero or less, banned at -threshold
+	Violations  map[Violation]int
+	Good        int // replies that passed every check
+	Failures    int // timeouts since the last good reply
+	BannedUntil time.Time
+}
+
+func (r *PeerRecord) banned(now time.Time) bool {
+	return now.Before(r.BannedUntil)
+}
+
+type Reputation struct {
+	Clock     Clock // when bans start and end
+	threshold int   // 0 disables automatic bans
+	duration  time.Duration
+	mu        sync.Mutex
+	peers     map[string]*PeerRecord
+}
+
+func NewReputation(threshold int, duration time.Duration) *Reputation {
+	r := new(Reputation)
+	r.Clock = SystemClock
+	r.threshold = threshold
+	r.duration = duration
+	r.peers = make(map[string]*PeerRecord)
+	return r
+}
+
+// Normalize a node ID or IP so both spellings of one target match.
+func banTarget(target string) (string, error) {
+	if id, err := parseNodeID(target); err == nil {
+		return id.AsString(), nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("%q is neither a node ID nor an IP", target)
+}
+
+func (r *Reputation) record(target string) *PeerRecord {
+	p, ok := r.peers[target]
+	if !ok {
+		p = &PeerRecord{Target: target, Violations: make(map[Violation]int)}
+		r.peers[target] = p
+	}
+	return p
+}
+
+func (r *Reputation) penalize(target string, kind Violation, now time.Time) bool {
+	p := r.record(target)
+	p.Violations[kind]++
+	p.Score -= violationPenalty[kind]
+	if kind == Timeout {
+		p.Failures++
+	}
+	if r.threshold > 0 && p.Score <= -r.threshold && !p.banned(now) {
+		p.BannedUntil = now.Add(r.duration)
+		p.Score = 0
+		return true
+	}
+	return false
+}
+
+// Count a violation against c and report whether it got c banned.
+func (r *Reputation) Penalize(c Contact, kind Violation) bool {
+	if r == nil {
+		return false
+	}
+	now := r.Clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	banned := r.penalize(c.NodeID.AsString(), kind, now)
+	if c.Host != nil && !c.Host.IsLoopback() && kind != Timeout {
+		banned = r.penalize(c.Host.String(), kind, now) || banned
+	}
+	return banned
+}
+
+// Count a violation against the address a request came from and report
+// whether it got the address banned.
+func (r *Reputation) PenalizeSource(ip net.IP, kind Violation) bool {
+	if r == nil || ip == nil || ip.IsLoopback() {
+		return false
+	}
+	now := r.Clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.penalize(ip.String(), kind, now)
+}
+
+// Count a good reply from c, winning back one point.
+func (r *Reputation) Reward(c Contact) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	targets := []string{c.NodeID.AsString()}
+	if c.Host != nil {
+		targets = append(targets, c.Host.String())
+	}
+	for _, target := range targets {
+		if p, ok := r.peers[target]; ok {
+			p.Good++
+			p.Failures = 0
+			if p.Score < 0 {
+				p.Score++
+			}
+		}
+	}
+}
+
+// Return a copy of the violations counted against a node ID or IP.
+func (r *Reputation) Violations(target string) map[Violation]int {
+	result := make(map[Violation]int)
+	target, err := banTarget(target)
+	if r == nil || err != nil {
+		return result
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.peers[target]; ok {
+		for kind, n := range p.Violations {
+			result[kind] = n
+		}
+	}
+	return result
+}
+
+// Whether c's node ID or IP is banned.
+func (r *Reputation) Banned(c Contact) bool {
+	if r == nil {
+		return false
+	}
+	now := r.Clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.peers[c.NodeID.AsString()]; ok && p.banned(now) {
+		return true
+	}
+	if c.Host == nil {
+		return false
+	}
+	p, ok := r.peers[c.Host.String()]
+	return ok && p.banned(now)
+}
+
+// Whether c has timed out staleFailures times in a row.
+func (r *Reputation) Stale(c Contact) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[c.NodeID.AsString()]
+	return ok && p.Failures >= staleFailures
+}
+
+// Ban a node ID or IP for d, or for the configured duration if d is zero.
+func (r *Reputation) Ban(target string, d time.Duration) (time.Time, error) {
+	target, err := banTarget(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if d <= 0 {
+		d = r.duration
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.record(target)
+	p.BannedUntil = r.Clock.Now().Add(d)
+	return p.BannedUntil, nil
+}
+
+// Lift a ban and forget the score of a node ID or IP.
+func (r *Reputation) Unban(target string) error {
+	target, err := banTarget(target)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[target]; !ok {
+		return fmt.Errorf("%s is not known", target)
+	}
+	delete(r.peers, target)
+	return nil
+}
+
+// Return a copy of every record, banned and lowest scores first.
+func (r *Reputation) Peers() []PeerRecord {
+	now := r.Clock.Now()
+	r.mu.Lock()
+	result := make([]PeerRecord, 0, len(r.peers))
+	for _, p := range r.peers {
+		each := *p
+		each.Violations = make(map[Violation]int)
+		for kind, n := range p.Violations {
+			each.Violations[kind] = n
+		}
+		result = append(result, each)
+	}
+	r.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		bi, bj := result[i].banned(now), result[j].banned(now)
+		if bi != bj {
+			return bi
+		}
+		if result[i].Score != result[j].Score {
+			return result[i].Score < result[j].Score
+		}
+		return result[i].Target < result[j].Target
+	})
+	return result
+}
+
+// Record a violation by c, and drop it from the routing table if that got it
+// banned or it keeps timing out.
+func (k *Kademlia) recordViolation(c Contact, kind Violation) {
+	switch {
+	case k.Reputation.Penalize(c, kind):
+		k.Logger.Warn("peer banned", F("peer", c.NodeID), F("host", c.Host), F("violation", kind))
+		go k.AddrBook.Remove(c.NodeID)
+	case kind == Timeout && k.Reputation.Stale(c):
+		go k.AddrBook.Remove(c.NodeID)
+	}
+}
+
+// Drop contacts that are malformed or banned from a list returned by c,
+// counting an invalid record against c for each malformed one. Lists longer
+// than our K are cut short without penalty, since peers may use a larger K.
+func (k *Kademlia) checkContacts(c Contact, nodes []Contact) []Contact {
+	result := make([]Contact, 0, len(nodes))
+	if len(nodes) > k.Config.K {
+		nodes = nodes[:k.Config.K]
+	}
+	for _, each := range nodes {
+		switch {
+		case each.Host == nil || each.Port == 0:
+			k.recordViolation(c, InvalidRecord)
+		case k.Reputation.Banned(each):
+		default:
+			result = append(result, each)
+		}
+	}
+	return result
+}
+
+// ======================= CLI ===================
+func (k *Kademlia) DoBan(target string, d time.Duration) string {
+	until, err := k.Reputation.Ban(target, d)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	for _, c := range k.AddrBook.Contacts() {
+		if k.Reputation.Banned(c) {
+			k.AddrBook.Remove(c.NodeID)
+		}
+	}
+	return "OK: Banned " + target + " until " + until.Format(time.RFC3339)
+}
+
+func (k *Kademlia) DoUnban(target string) string {
+	if err := k.Reputation.Unban(target); err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: Unbanned " + target
+}
+
+func (k *Kademlia) DoPeers() string {
+	peers := k.Reputation.Peers()
+	lines := []string{fmt.Sprintf("OK: %d peers", len(peers))}
+	now := k.Clock.Now()
+	for _, p := range peers {
+		line := fmt.Sprintf("%s score=%d good=%d", p.Target, p.Score, p.Good)
+		kinds := make([]string, 0, len(p.Violations))
+		for kind, n := range p.Violations {
+			kinds = append(kinds, fmt.Sprintf("%s=%d", strings.Replace(kind.String(), " ", "-", -1), n))
+		}
+		sort.Strings(kinds)
+		if len(kinds) > 0 {
+			line += " " + strings.Join(kinds, " ")
+		}
+		if p.banned(now) {
+			line += " banned-for=" + p.BannedUntil.Sub(now).Round(time.Second).String()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
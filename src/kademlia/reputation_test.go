@@ -0,0 +1,82 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ReputationBan(t *testing.T) {
+	r := NewReputation(20, time.Minute)
+	peer := Contact{NewRandomID(), net.IPv4(10, 0, 0, 1), 7000, nil}
+	neighbour := Contact{NewRandomID(), net.IPv4(10, 0, 0, 1), 7001, nil}
+	assertTrue(!r.Penalize(peer, BadMsgID), "Banned after one violation", t)
+	assertTrue(r.Penalize(peer, InvalidRecord), "Not banned at the threshold", t)
+	assertTrue(r.Banned(peer), "Ban not reported", t)
+	assertTrue(r.Banned(neighbour), "IP not banned", t)
+
+	assertTrue(r.Unban(peer.Host.String()) == nil, "IP not unbanned", t)
+	assertTrue(!r.Banned(neighbour), "Neighbour still banned", t)
+	assertTrue(r.Unban(strings.ToUpper(peer.NodeID.AsString())) == nil, "Node ID not unbanned", t)
+	assertTrue(!r.Banned(peer), "Peer still banned", t)
+	assertTrue(r.Unban("nonsense") != nil, "Invalid target accepted", t)
+
+	local := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, nil}
+	for i := 0; i < 5; i++ {
+		r.Penalize(local, Timeout)
+	}
+	assertTrue(!r.Banned(local), "Banned for a few timeouts", t)
+	assertTrue(r.Stale(local), "Contact timing out not stale", t)
+	r.Reward(local)
+	assertTrue(!r.Stale(local), "Good reply did not reset failures", t)
+}
+
+func Test_BannedSenderRefused(t *testing.T) {
+	conf := DefaultConfig()
+	conf.BanThreshold = 10
+	k := NewKademliaWithConfig("localhost:7977", conf)
+	peer := instance[2].SelfContact
+	k.DoPing(peer.Host, peer.Port)
+	_, err := k.AddrBook.FindOne(peer.NodeID)
+	assertTrue(err == nil, "Peer not added", t)
+
+	k.recordViolation(peer, BadMsgID)
+	err = k.checkRequest(peer, nil, NewRandomID(), NewEnvelope())
+	assertTrue(errors.Is(err, ErrBanned), "Request from banned peer accepted", t)
+	assertTrue(strings.Contains(k.DoPeers(), "banned-for="), "Ban not listed", t)
+	time.Sleep(time.Millisecond * 50)
+	_, err = k.AddrBook.FindOne(peer.NodeID)
+	assertTrue(err != nil, "Banned peer kept in routing table", t)
+
+	assertTrue(strings.HasPrefix(k.DoUnban(peer.NodeID.AsString()), "OK:"), "Unban failed", t)
+	err = k.checkRequest(peer, nil, NewRandomID(), NewEnvelope())
+	assertTrue(err == nil, "Request refused after unban", t)
+	assertTrue(strings.HasPrefix(k.DoBan(peer.NodeID.AsString(), time.Minute), "OK:"), "Ban failed", t)
+	assertTrue(k.Reputation.Banned(peer), "Manual ban not applied", t)
+}
+
+/*
+ * Stale requests claiming to come from an honest peer count against the
+ * address they came from, never against the peer they name.
+ */
+func Test_SpoofedSenderNotBanned(t *testing.T) {
+	conf := DefaultConfig()
+	conf.BanThreshold = 10
+	k := NewKademliaWithConfig("localhost:7990", conf)
+	honest := instance[2].SelfContact
+	attacker := net.IPv4(10, 0, 0, 66)
+	core := &KademliaCore{k, attacker}
+	stale := Envelope{ProtocolVersion, time.Now().Add(-2 * EnvelopeWindow).Unix()}
+	for i := 0; i < 5; i++ {
+		var res FindNodeResult
+		core.FindNode(FindNodeRequest{honest, NewRandomID(), NewRandomID(), stale}, &res)
+	}
+	assertTrue(!k.Reputation.Banned(honest), "Honest peer banned by spoofed requests", t)
+	assertTrue(k.Reputation.Banned(Contact{Host: attacker}), "Source address not banned", t)
+	err := k.checkRequest(honest, nil, NewRandomID(), NewEnvelope())
+	assertTrue(err == nil, "Honest peer refused", t)
+	err = k.checkRequest(honest, attacker, NewRandomID(), NewEnvelope())
+	assertTrue(errors.Is(err, ErrBanned), "Banned address not refused", t)
+}
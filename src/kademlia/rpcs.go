@@ -6,64 +6,184 @@ package kademlia
 
 import (
 	"net"
+	"time"
 )
 
 type KademliaCore struct {
 	kademlia *Kademlia
+	source   net.IP // address the requests come from, nil if unknown
 }
 
-// Host identification.
+// Host identification. Host and Port are the preferred address; Addrs lists
+// any others the node can be reached on, such as its IPv6 addresses.
 type Contact struct {
 	NodeID ID
 	Host   net.IP
 	Port   uint16
+	Addrs  []Address
 }
 
 func (c Contact) Equal(a Contact) bool {
 	return c.NodeID == a.NodeID && c.Host.Equal(a.Host) && c.Port == a.Port
 }
 
+// All known addresses of the contact, preferred address first.
+func (c Contact) Addresses() []Address {
+	result := make([]Address, 0, len(c.Addrs)+1)
+	if c.Host != nil {
+		result = append(result, Address{c.Host, c.Port})
+	}
+	for _, each := range c.Addrs {
+		dup := false
+		for _, seen := range result {
+			if seen.Equal(each) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			result = append(result, each)
+		}
+	}
+	return result
+}
+
+// The sender's contact as this node should keep it. A request from another
+// host loses the loopback addresses, they lead back to this host. Returns
+// false if no address is left.
+func (kc *KademliaCore) reachable(sender Contact) (Contact, bool) {
+	if kc.source == nil || kc.source.IsLoopback() {
+		return sender, true
+	}
+	addrs := make([]Address, 0)
+	for _, each := range sender.Addresses() {
+		if !each.Host.IsLoopback() {
+			addrs = append(addrs, each)
+		}
+	}
+	if len(addrs) == 0 {
+		return Contact{}, false
+	}
+	return Contact{sender.NodeID, addrs[0].Host, addrs[0].Port, addrs[1:]}, true
+}
+
+// Record metrics and a log line for an RPC we handled.
+func (kc *KademliaCore) received(name string, sender Contact, msgId ID, start time.Time, err error) {
+	took := kc.kademlia.Clock.Now().Sub(start)
+	kc.kademlia.Metrics.RPCReceived(name, took, err)
+	kc.kademlia.Events.emit(Event{Kind: EventRPCReceived, Contact: sender, RPC: name, Err: err})
+	fields := []Field{F("rpc", name), F("peer", sender.NodeID), F("msgid", msgId),
+		F("duration", took)}
+	if err == nil {
+		kc.kademlia.Logger.Debug("rpc received", fields...)
+	} else {
+		kc.kademlia.Logger.Warn("rpc rejected", append(fields, F("err", err))...)
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // PING
 ///////////////////////////////////////////////////////////////////////////////
 type PingMessage struct {
-	Sender Contact
-	MsgID  ID
+	Sender       Contact
+	MsgID        ID
+	Capabilities Capabilities
+	Envelope
 }
 
 type PongMessage struct {
-	MsgID  ID
-	Sender Contact
+	MsgID        ID
+	Sender       Contact
+	Capabilities Capabilities
+	Envelope
 }
 
-func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
+func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() { kc.received("ping", ping.Sender, ping.MsgID, start, err) }()
 	// TODO: Finish implementation
+	// PING negotiates the version, so newer peers are not refused here
+	env := ping.Envelope
+	env.Version = negotiatedVersion(env.Version)
+	if err := kc.kademlia.checkRequest(ping.Sender, kc.source, ping.MsgID, env); err != nil {
+		return err
+	}
 	pong.MsgID = CopyID(ping.MsgID)
 	pong.Sender = kc.kademlia.SelfContact
-	go kc.kademlia.AddrBook.Update(ping.Sender)
+	pong.Capabilities = kc.kademlia.Capabilities()
+	pong.Envelope = NewEnvelope()
+	if sender, ok := kc.reachable(ping.Sender); ok {
+		go kc.kademlia.AddrBook.UpdatePeer(sender, PeerInfo{env.Version, ping.Capabilities})
+	}
 	return nil
 }
 
+// Report a refused request in the result if the sender understands error
+// codes, otherwise fail the RPC with err.
+func (kc *KademliaCore) refuse(sender Contact, env Envelope, res *RPCError, err error) error {
+	if kc.kademlia.sharedCapabilities(sender.NodeID, env.Version).Has(CapErrorCodes) {
+		*res = rpcErrorFrom(err)
+		return nil
+	}
+	return err
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // STORE
 ///////////////////////////////////////////////////////////////////////////////
+// A Cache store asks for a copy kept only for TTL, or the receiver's CacheTTL
+// if that is shorter or TTL is zero, and is accepted whether or not the
+// receiver is responsible for the key.
 type StoreRequest struct {
 	Sender Contact
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	Cache  bool
+	TTL    time.Duration
+	Envelope
 }
 
+// If the store was refused with CodeNotResponsible, Nodes holds the contacts
+// the receiver knows closer to the key.
 type StoreResult struct {
 	MsgID ID
-	Err   error
+	Nodes []Contact
+	Err   RPCError
+	Reads int64 // reads of the cached copy replaced, see hot.go
+	Envelope
 }
 
-func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
+func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() {
+		kc.received("store", req.Sender, req.MsgID, start, handlerError(err, res.Err))
+	}()
 	// TODO: Implement.
-	go kc.kademlia.AddrBook.Update(req.Sender)
-	kc.kademlia.addData(Pair{req.Key, req.Value})
 	res.MsgID = CopyID(req.MsgID)
+	res.Envelope = NewEnvelope()
+	if err := kc.kademlia.checkRequest(req.Sender, kc.source, req.MsgID, req.Envelope); err != nil {
+		return kc.refuse(req.Sender, req.Envelope, &res.Err, err)
+	}
+	if sender, ok := kc.reachable(req.Sender); ok {
+		go kc.kademlia.AddrBook.Update(sender)
+	}
+	origin := ValueOrigin{OriginStore, req.Sender.NodeID}
+	ttl := kc.kademlia.Config.CacheTTL
+	if req.Cache {
+		origin.Kind = OriginCache
+		res.Reads = kc.kademlia.LocalData.Served(req.Key)
+		if req.TTL > 0 && req.TTL < ttl {
+			ttl = req.TTL
+		}
+	} else if kc.kademlia.Config.ResponsibleOnly {
+		if closer := kc.kademlia.closerContacts(req.Key); len(closer) > 0 {
+			res.Nodes = closer
+			return kc.refuse(req.Sender, req.Envelope, &res.Err, &ProtocolError{
+				CodeNotResponsible, "not among the k closest nodes to " + req.Key.AsString()})
+		}
+	}
+	kc.kademlia.addDataFor(Pair{req.Key, req.Value}, origin, kc.kademlia.Clock.Now(), ttl)
 	return nil
 }
 
@@ -74,22 +194,32 @@ type FindNodeRequest struct {
 	Sender Contact
 	MsgID  ID
 	NodeID ID
+	Envelope
 }
 
 type FindNodeResult struct {
 	MsgID ID
 	Nodes []Contact
-	Err   error
+	Err   RPCError
+	Envelope
 }
 
-func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error {
+func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() {
+		kc.received("find_node", req.Sender, req.MsgID, start, handlerError(err, res.Err))
+	}()
 	// TODO: Implement.
 	// find closest nodes to the key
-	go kc.kademlia.AddrBook.Update(req.Sender)
-	contacts := kc.kademlia.AddrBook.Find(req.NodeID)
-
 	res.MsgID = CopyID(req.MsgID)
-	res.Nodes = contacts
+	res.Envelope = NewEnvelope()
+	if err := kc.kademlia.checkRequest(req.Sender, kc.source, req.MsgID, req.Envelope); err != nil {
+		return kc.refuse(req.Sender, req.Envelope, &res.Err, err)
+	}
+	if sender, ok := kc.reachable(req.Sender); ok {
+		go kc.kademlia.AddrBook.Update(sender)
+	}
+	res.Nodes = kc.kademlia.AddrBook.Find(req.NodeID)
 
 	return nil
 }
@@ -101,51 +231,124 @@ type FindValueRequest struct {
 	Sender Contact
 	MsgID  ID
 	Key    ID
+	Envelope
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
-// FindNodeResult.
+// FindNodeResult. Cached is set if Value is a copy that will expire; older
+// nodes never set it.
 type FindValueResult struct {
-	MsgID ID
-	Value []byte
-	Nodes []Contact
-	Err   error
+	MsgID  ID
+	Value  []byte
+	Nodes  []Contact
+	Err    RPCError
+	Cached bool
+	Envelope
 }
 
-func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
+func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() {
+		kc.received("find_value", req.Sender, req.MsgID, start, handlerError(err, res.Err))
+	}()
 	// TODO: Implement.
-	go kc.kademlia.AddrBook.Update(req.Sender)
+	res.MsgID = CopyID(req.MsgID)
+	res.Envelope = NewEnvelope()
+	if err := kc.kademlia.checkRequest(req.Sender, kc.source, req.MsgID, req.Envelope); err != nil {
+		return kc.refuse(req.Sender, req.Envelope, &res.Err, err)
+	}
+	if sender, ok := kc.reachable(req.Sender); ok {
+		go kc.kademlia.AddrBook.Update(sender)
+	}
 
-	value, err := kc.kademlia.getData(req.Key)
-	if err == nil {
-		res.MsgID = CopyID(req.MsgID)
+	if value, err := kc.kademlia.getData(req.Key); err == nil {
 		res.Value = value
 		res.Nodes = nil
-		res.Err = nil
+		_, info, _ := kc.kademlia.LocalData.Peek(req.Key)
+		res.Cached = !info.Expires.IsZero()
 	} else {
-		res.MsgID = CopyID(req.MsgID)
 		res.Value = nil
 		res.Nodes = kc.kademlia.AddrBook.Find(req.Key)
-		res.Err = nil
 	}
 
 	return nil
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// LEAVE
+///////////////////////////////////////////////////////////////////////////////
+// Sent by a node shutting down to the contacts in its routing table, only
+// over net/rpc. Older nodes do not know it and fail the RPC.
+type LeaveRequest struct {
+	Sender Contact
+	MsgID  ID
+	Envelope
+}
+
+type LeaveResult struct {
+	MsgID ID
+	Err   RPCError
+	Envelope
+}
+
+func (kc *KademliaCore) Leave(req LeaveRequest, res *LeaveResult) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() {
+		kc.received("leave", req.Sender, req.MsgID, start, handlerError(err, res.Err))
+	}()
+	res.MsgID = CopyID(req.MsgID)
+	res.Envelope = NewEnvelope()
+	if err := kc.kademlia.checkRequest(req.Sender, kc.source, req.MsgID, req.Envelope); err != nil {
+		return kc.refuse(req.Sender, req.Envelope, &res.Err, err)
+	}
+	// only drop the contact if the sender matches it and the request comes
+	// from one of its addresses, so a peer cannot remove others by claiming
+	// their ID
+	known, err := kc.kademlia.AddrBook.FindOne(req.Sender.NodeID)
+	if err == nil && known.Equal(req.Sender) && kc.fromAddressOf(*known) {
+		kc.kademlia.AddrBook.Remove(req.Sender.NodeID)
+	}
+	return nil
+}
+
+// Whether the requests come from one of c's addresses. Loopback addresses
+// all stand for this host, so any of them matches another.
+func (kc *KademliaCore) fromAddressOf(c Contact) bool {
+	if kc.source == nil {
+		return false
+	}
+	for _, each := range c.Addresses() {
+		if each.Host.Equal(kc.source) || each.Host.IsLoopback() && kc.source.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
 //Project 3 Vanish
 type GetVDORequest struct {
 	Sender Contact
 	MsgID  ID
 	VdoID  ID
+	Envelope
 }
 
 type GetVDOResult struct {
 	MsgID ID
 	VDO   VanashingDataObject
+	Envelope
 }
 
-func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
-	go kc.kademlia.AddrBook.Update(req.Sender)
+func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) (err error) {
+	start := kc.kademlia.Clock.Now()
+	defer func() { kc.received("get_vdo", req.Sender, req.MsgID, start, err) }()
+	if err := kc.kademlia.checkRequest(req.Sender, kc.source, req.MsgID, req.Envelope); err != nil {
+		return err
+	}
+	if sender, ok := kc.reachable(req.Sender); ok {
+		go kc.kademlia.AddrBook.Update(sender)
+	}
+	res.Envelope = NewEnvelope()
 	vdo, err := kc.kademlia.getVdoData(req.VdoID)
 	if err == nil {
 		res.MsgID = CopyID(req.MsgID)
@@ -0,0 +1,181 @@
+package kademlia
+
+// Contains the local key/value store. Keys are spread over shards by their
+// first byte, each shard behind its own RWMutex, so concurrent STORE and
+// FIND_VALUE RPCs only contend when they hit the same shard and lookups
+// never wait for each other. Values with an expiry time are cached copies;
+// they stop being returned once expired and are dropped by Expire. Each value
+// counts its reads through Get, which ReadCounts collects for hot-key
+// detection, and separately since it was last stored, which Served reports.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	storeShards = 16
+	// shortest interval between sweeps for expired cached values
+	cacheSweepMin = time.Millisecond * 10
+)
+
+type DataStore struct {
+	Clock  Clock // when cached copies expire
+	shards [storeShards]storeShard
+}
+
+type storeShard struct {
+	sync.RWMutex
+	values map[ID]storedValue
+}
+
+type storedValue struct {
+	value  []byte
+	info   ValueInfo
+	reads  *int64 // Gets since the last ReadCounts, kept when replaced
+	served *int64 // Gets since stored
+}
+
+func NewDataStore() *DataStore {
+	s := new(DataStore)
+	s.Clock = SystemClock
+	for i := range s.shards {
+		s.shards[i].values = make(map[ID]storedValue)
+	}
+	return s
+}
+
+func (s *DataStore) shard(key ID) *storeShard {
+	return &s.shards[int(key[0])%storeShards]
+}
+
+// Store value under key, replacing any previous value, and report whether
+// it was stored. A zero expires keeps the value until it is deleted. A value
+// that expires never replaces one that does not.
+func (s *DataStore) Put(key ID, value []byte, origin ValueOrigin, at, expires time.Time) bool {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	old, ok := sh.values[key]
+	if ok && !expires.IsZero() && old.info.Expires.IsZero() {
+		return false
+	}
+	reads := old.reads
+	if reads == nil {
+		reads = new(int64)
+	}
+	sh.values[key] = storedValue{value, ValueInfo{key, len(value), at, origin, expires}, reads, new(int64)}
+	return true
+}
+
+// Return the value of key, counting the read.
+func (s *DataStore) Get(key ID) ([]byte, bool) {
+	stored, ok := s.get(key)
+	if ok {
+		atomic.AddInt64(stored.reads, 1)
+		atomic.AddInt64(stored.served, 1)
+	}
+	return stored.value, ok
+}
+
+// Return the number of reads of key since it was last stored.
+func (s *DataStore) Served(key ID) int64 {
+	if stored, ok := s.get(key); ok {
+		return atomic.LoadInt64(stored.served)
+	}
+	return 0
+}
+
+// Return the value of key and its info without counting a read.
+func (s *DataStore) Peek(key ID) ([]byte, ValueInfo, bool) {
+	stored, ok := s.get(key)
+	return stored.value, stored.info, ok
+}
+
+func (s *DataStore) get(key ID) (storedValue, bool) {
+	sh := s.shard(key)
+	sh.RLock()
+	stored, ok := sh.values[key]
+	sh.RUnlock()
+	if ok && stored.expired(s.Clock.Now()) {
+		return storedValue{}, false
+	}
+	return stored, ok
+}
+
+// Return the number of reads of every value read since the last call, and
+// start counting again from zero.
+func (s *DataStore) ReadCounts() map[ID]int64 {
+	counts := make(map[ID]int64)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for key, stored := range sh.values {
+			if n := atomic.SwapInt64(stored.reads, 0); n > 0 {
+				counts[key] = n
+			}
+		}
+		sh.RUnlock()
+	}
+	return counts
+}
+
+func (v storedValue) expired(now time.Time) bool {
+	return !v.info.Expires.IsZero() && !now.Before(v.info.Expires)
+}
+
+// Drop every value that expired by now and return their info.
+func (s *DataStore) Expire(now time.Time) []ValueInfo {
+	expired := make([]ValueInfo, 0)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.Lock()
+		for key, stored := range sh.values {
+			if stored.expired(now) {
+				delete(sh.values, key)
+				expired = append(expired, stored.info)
+			}
+		}
+		sh.Unlock()
+	}
+	return expired
+}
+
+// Remove key, reporting whether it was held.
+func (s *DataStore) Delete(key ID) bool {
+	sh := s.shard(key)
+	sh.Lock()
+	_, ok := sh.values[key]
+	delete(sh.values, key)
+	sh.Unlock()
+	return ok
+}
+
+// Return the number of keys and bytes of values held.
+func (s *DataStore) Stats() (keys int, size int) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		keys += len(sh.values)
+		for _, stored := range sh.values {
+			size += len(stored.value)
+		}
+		sh.RUnlock()
+	}
+	return keys, size
+}
+
+// Return the info of every value held, in no particular order.
+func (s *DataStore) List() []ValueInfo {
+	infos := make([]ValueInfo, 0)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.RLock()
+		for _, stored := range sh.values {
+			infos = append(infos, stored.info)
+		}
+		sh.RUnlock()
+	}
+	return infos
+}
@@ -0,0 +1,112 @@
+package kademlia
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_DataStoreConcurrent(t *testing.T) {
+	s := NewDataStore()
+	keys := benchmarkTargets(200)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i, key := range keys {
+				if i%8 == w {
+					s.Put(key, []byte(strconv.Itoa(i)), ValueOrigin{Kind: OriginLocal}, time.Now(), time.Time{})
+				} else {
+					s.Get(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	n, _ := s.Stats()
+	assertIntEqual(len(keys), n, "Wrong number of keys after concurrent puts", t)
+	assertIntEqual(len(keys), len(s.List()), "Wrong number of keys listed", t)
+	for i, key := range keys {
+		value, ok := s.Get(key)
+		assertTrue(ok && string(value) == strconv.Itoa(i), "Value lost or mixed up", t)
+	}
+	assertTrue(s.Delete(keys[0]), "Delete missed a held key", t)
+	assertFalse(s.Delete(keys[0]), "Delete reported a missing key", t)
+	_, ok := s.Get(keys[0])
+	assertFalse(ok, "Deleted key still held", t)
+}
+
+// STORE and FIND_VALUE traffic against one node's local store, one store in
+// ten operations.
+func Benchmark_LocalDataParallel(b *testing.B) {
+	k := instance[10]
+	keys := benchmarkTargets(1024)
+	for _, key := range keys {
+		k.addData(Pair{key, []byte("benchmark value")})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				k.addData(Pair{key, []byte("benchmark value")})
+			} else if _, err := k.getData(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func Test_StoreResponsibility(t *testing.T) {
+	conf := DefaultConfig()
+	conf.K = 4
+	conf.ResponsibleOnly = true
+	conf.CacheTTL = time.Millisecond * 200
+	k := NewKademliaWithConfig("localhost:7976", conf)
+	k.Bootstrap([]string{"localhost:" + strconv.Itoa(int(instance[0].SelfContact.Port))})
+	ch, cancel := k.Events.Subscribe(64)
+	defer cancel()
+
+	// differs from our ID in the first bit, so every contact in bucket 0 is
+	// closer to it than we are
+	far := k.NodeID
+	far[0] ^= 0x80
+	near := k.NodeID
+	near[IDBytes-1] ^= 1
+
+	_, closer, err := instance[1].storeValue(&k.SelfContact, far, []byte("far"), false, 0)
+	assertTrue(errors.Is(err, ErrNotResponsible), "Far key accepted", t)
+	assertIntEqual(conf.K, len(closer), "Refusal without closer contacts", t)
+	for _, each := range closer {
+		assertTrue(far.Xor(each.NodeID).Less(far.Xor(k.NodeID)), "Suggested contact is not closer", t)
+	}
+	_, _, err = instance[1].storeValue(&k.SelfContact, near, []byte("near"), false, 0)
+	assertTrue(err == nil, "Near key refused", t)
+
+	_, _, err = instance[1].storeValue(&k.SelfContact, far, []byte("cached"), true, 0)
+	assertTrue(err == nil, "Cache store refused", t)
+	_, _, err = instance[1].storeValue(&k.SelfContact, near, []byte("cached"), true, 0)
+	assertTrue(err == nil, "Cache store over held value refused", t)
+	value, err := k.getData(near)
+	assertStringEqual("near", string(value), "Cache store replaced a held value", t)
+	value, err = k.getData(far)
+	assertStringEqual("cached", string(value), "Cached value not held", t)
+
+	deadline := time.After(time.Second * 2)
+	for expired := false; !expired; {
+		select {
+		case ev := <-ch:
+			expired = ev.Kind == EventValueExpired && ev.Key == far
+		case <-deadline:
+			t.Fatal("Cached value did not expire")
+		}
+	}
+	_, err = k.getData(far)
+	assertTrue(err != nil, "Expired value still held", t)
+	_, err = k.getData(near)
+	assertTrue(err == nil, "Held value expired", t)
+}
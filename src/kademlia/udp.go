@@ -0,0 +1,713 @@
+package kademlia
+
+// Contains the UDP transport: a compact binary encoding of PING, STORE,
+// FIND_NODE and FIND_VALUE, and a transport that matches replies to requests
+// by MsgID and retransmits on timeout. Requests are handed to the same
+// KademliaCore methods that serve net/rpc. Anything that does not fit in one
+// datagram, and any peer that never answers, falls back to TCP.
+//
+// Every packet starts with a header:
+//
+//	magic(1) kind(1) MsgID(20) version(1) timestamp(8)
+//
+// followed by a body depending on kind. Contacts are encoded as
+//
+//	NodeID(20) iplen(1) ip(iplen) port(2) naddrs(1) {iplen(1) ip port(2)}*
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	udpMagic = 0x4b
+	// keep datagrams under a typical MTU to avoid fragmentation
+	udpMaxPacket = 1400
+	// the fewest bytes a contact takes: NodeID, iplen, port and naddrs
+	udpMinContact = IDBytes + 4
+	// naddrs is one byte, further addresses are not sent
+	udpMaxAddrs = math.MaxUint8
+)
+
+const (
+	udpPing byte = iota + 1
+	udpPong
+	udpStore
+	udpStoreReply
+	udpFindNode
+	udpFindNodeReply
+	udpFindValue
+	udpFindValueReply
+	udpError
+	udpTooLarge
+)
+
+var errUDPTooLarge = errors.New("message too large for UDP")
+
+// Returned by UDPTransport.Call when the RPC should be retried over TCP.
+var errUDPFallback = errors.New("fall back to TCP")
+
+// Sent back when a handler returns an error.
+type udpErrorReply struct {
+	MsgID   ID
+	Message string
+}
+
+// Sent back when the reply would not fit in one datagram.
+type udpTooLargeReply struct {
+	MsgID ID
+}
+
+// ======================= Encoding ===================
+func writeIP(buf *bytes.Buffer, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	buf.WriteByte(byte(len(ip)))
+	buf.Write(ip)
+}
+
+func writeContact(buf *bytes.Buffer, c Contact) {
+	buf.Write(c.NodeID[:])
+	writeIP(buf, c.Host)
+	binary.Write(buf, binary.BigEndian, c.Port)
+	addrs := c.Addrs
+	if len(addrs) > udpMaxAddrs {
+		addrs = addrs[:udpMaxAddrs]
+	}
+	buf.WriteByte(byte(len(addrs)))
+	for _, each := range addrs {
+		writeIP(buf, each.Host)
+		binary.Write(buf, binary.BigEndian, each.Port)
+	}
+}
+
+func writeContacts(buf *bytes.Buffer, contacts []Contact) {
+	binary.Write(buf, binary.BigEndian, uint16(len(contacts)))
+	for _, each := range contacts {
+		writeContact(buf, each)
+	}
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+func writeRPCError(buf *bytes.Buffer, e RPCError) {
+	buf.WriteByte(byte(e.Code))
+	writeBytes(buf, []byte(e.Message))
+}
+
+func writeHeader(buf *bytes.Buffer, kind byte, msgId ID, env Envelope) {
+	buf.WriteByte(udpMagic)
+	buf.WriteByte(kind)
+	buf.Write(msgId[:])
+	buf.WriteByte(env.Version)
+	binary.Write(buf, binary.BigEndian, env.Timestamp)
+}
+
+// Encode one of the RPC message types into a datagram.
+func marshalUDP(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch m := msg.(type) {
+	case PingMessage:
+		writeHeader(&buf, udpPing, m.MsgID, m.Envelope)
+		writeContact(&buf, m.Sender)
+		binary.Write(&buf, binary.BigEndian, uint32(m.Capabilities))
+	case PongMessage:
+		writeHeader(&buf, udpPong, m.MsgID, m.Envelope)
+		writeContact(&buf, m.Sender)
+		binary.Write(&buf, binary.BigEndian, uint32(m.Capabilities))
+	case StoreRequest:
+		writeHeader(&buf, udpStore, m.MsgID, m.Envelope)
+		writeContact(&buf, m.Sender)
+		buf.Write(m.Key[:])
+		writeBytes(&buf, m.Value)
+		if m.Cache {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		binary.Write(&buf, binary.BigEndian, ttlMillis(m.TTL))
+	case StoreResult:
+		writeHeader(&buf, udpStoreReply, m.MsgID, m.Envelope)
+		writeRPCError(&buf, m.Err)
+		writeContacts(&buf, m.Nodes)
+		binary.Write(&buf, binary.BigEndian, m.Reads)
+	case FindNodeRequest:
+		writeHeader(&buf, udpFindNode, m.MsgID, m.Envelope)
+		writeContact(&buf, m.Sender)
+		buf.Write(m.NodeID[:])
+	case FindNodeResult:
+		writeHeader(&buf, udpFindNodeReply, m.MsgID, m.Envelope)
+		writeRPCError(&buf, m.Err)
+		writeContacts(&buf, m.Nodes)
+	case FindValueRequest:
+		writeHeader(&buf, udpFindValue, m.MsgID, m.Envelope)
+		writeContact(&buf, m.Sender)
+		buf.Write(m.Key[:])
+	case FindValueResult:
+		writeHeader(&buf, udpFindValueReply, m.MsgID, m.Envelope)
+		writeRPCError(&buf, m.Err)
+		if m.Value != nil {
+			buf.WriteByte(1)
+			writeBytes(&buf, m.Value)
+			if m.Cached {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		} else {
+			buf.WriteByte(0)
+			writeContacts(&buf, m.Nodes)
+		}
+	case udpErrorReply:
+		writeHeader(&buf, udpError, m.MsgID, NewEnvelope())
+		writeBytes(&buf, []byte(m.Message))
+	case udpTooLargeReply:
+		writeHeader(&buf, udpTooLarge, m.MsgID, NewEnvelope())
+	default:
+		return nil, errors.New("no UDP encoding for message")
+	}
+	if buf.Len() > udpMaxPacket {
+		return nil, errUDPTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// A TTL in whole milliseconds, clamped to what the uint32 field holds.
+func ttlMillis(ttl time.Duration) uint32 {
+	switch ms := ttl / time.Millisecond; {
+	case ms < 0:
+		return 0
+	case ms > math.MaxUint32:
+		return math.MaxUint32
+	default:
+		return uint32(ms)
+	}
+}
+
+type udpReader struct {
+	r   *bytes.Reader
+	k   int // contacts to make room for ahead of reading them
+	err error
+}
+
+func (u *udpReader) read(data interface{}) {
+	if u.err == nil {
+		u.err = binary.Read(u.r, binary.BigEndian, data)
+	}
+}
+
+func (u *udpReader) byte() byte {
+	var b byte
+	u.read(&b)
+	return b
+}
+
+// Whether anything is left to read. Fields added to a message since the
+// first version are only read if present.
+func (u *udpReader) more() bool {
+	return u.err == nil && u.r.Len() > 0
+}
+
+func (u *udpReader) id() (ret ID) {
+	u.read(&ret)
+	return
+}
+
+func (u *udpReader) ip() net.IP {
+	n := u.byte()
+	if u.err == nil && n == 0 {
+		return nil
+	}
+	if u.err == nil && n != net.IPv4len && n != net.IPv6len {
+		u.err = errors.New("bad IP length")
+	}
+	if u.err != nil {
+		return nil
+	}
+	ip := make(net.IP, n)
+	_, u.err = io.ReadFull(u.r, ip)
+	return ip
+}
+
+func (u *udpReader) contact() (c Contact) {
+	c.NodeID = u.id()
+	c.Host = u.ip()
+	u.read(&c.Port)
+	n := int(u.byte())
+	for i := 0; i < n && u.err == nil; i++ {
+		a := Address{Host: u.ip()}
+		u.read(&a.Port)
+		c.Addrs = append(c.Addrs, a)
+	}
+	return
+}
+
+func (u *udpReader) contacts() []Contact {
+	var n uint16
+	u.read(&n)
+	if u.err == nil && int(n)*udpMinContact > u.r.Len() {
+		u.err = errors.New("truncated contacts")
+	}
+	if u.err != nil {
+		return nil
+	}
+	size := int(n)
+	if size > u.k {
+		size = u.k
+	}
+	result := make([]Contact, 0, size)
+	for i := uint16(0); i < n && u.err == nil; i++ {
+		result = append(result, u.contact())
+	}
+	return result
+}
+
+func (u *udpReader) bytes() []byte {
+	var n uint32
+	u.read(&n)
+	if u.err == nil && int(n) > u.r.Len() {
+		u.err = errors.New("truncated value")
+	}
+	if u.err != nil {
+		return nil
+	}
+	data := make([]byte, n)
+	_, u.err = io.ReadFull(u.r, data)
+	return data
+}
+
+func (u *udpReader) capabilities() Capabilities {
+	var caps uint32
+	u.read(&caps)
+	return Capabilities(caps)
+}
+
+func (u *udpReader) rpcError() RPCError {
+	code := ErrorCode(u.byte())
+	return RPCError{code, string(u.bytes())}
+}
+
+// Decode a datagram into one of the RPC message types. k is the number of
+// contacts a reply usually holds.
+func unmarshalUDP(data []byte, k int) (interface{}, error) {
+	u := &udpReader{r: bytes.NewReader(data), k: k}
+	if u.byte() != udpMagic {
+		return nil, errors.New("not a kademlia packet")
+	}
+	kind := u.byte()
+	msgId := u.id()
+	var env Envelope
+	env.Version = u.byte()
+	u.read(&env.Timestamp)
+
+	var msg interface{}
+	switch kind {
+	case udpPing:
+		m := PingMessage{Sender: u.contact(), MsgID: msgId, Envelope: env}
+		m.Capabilities = u.capabilities()
+		msg = m
+	case udpPong:
+		m := PongMessage{MsgID: msgId, Sender: u.contact(), Envelope: env}
+		m.Capabilities = u.capabilities()
+		msg = m
+	case udpStore:
+		m := StoreRequest{Sender: u.contact(), MsgID: msgId, Envelope: env}
+		m.Key = u.id()
+		m.Value = u.bytes()
+		if u.more() {
+			m.Cache = u.byte() == 1
+		}
+		if u.more() {
+			var ttl uint32
+			u.read(&ttl)
+			m.TTL = time.Duration(ttl) * time.Millisecond
+		}
+		msg = m
+	case udpStoreReply:
+		m := StoreResult{MsgID: msgId, Err: u.rpcError(), Envelope: env}
+		if u.more() {
+			m.Nodes = u.contacts()
+		}
+		if u.more() {
+			u.read(&m.Reads)
+		}
+		msg = m
+	case udpFindNode:
+		m := FindNodeRequest{Sender: u.contact(), MsgID: msgId, Envelope: env}
+		m.NodeID = u.id()
+		msg = m
+	case udpFindNodeReply:
+		m := FindNodeResult{MsgID: msgId, Err: u.rpcError(), Envelope: env}
+		m.Nodes = u.contacts()
+		msg = m
+	case udpFindValue:
+		m := FindValueRequest{Sender: u.contact(), MsgID: msgId, Envelope: env}
+		m.Key = u.id()
+		msg = m
+	case udpFindValueReply:
+		m := FindValueResult{MsgID: msgId, Err: u.rpcError(), Envelope: env}
+		if u.byte() == 1 {
+			m.Value = u.bytes()
+			if u.more() {
+				m.Cached = u.byte() == 1
+			}
+		} else {
+			m.Nodes = u.contacts()
+		}
+		msg = m
+	case udpError:
+		msg = udpErrorReply{msgId, string(u.bytes())}
+	case udpTooLarge:
+		msg = udpTooLargeReply{msgId}
+	default:
+		return nil, errors.New("unknown packet kind")
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	return msg, nil
+}
+
+// ======================= Transport ===================
+type UDPTransport struct {
+	core    *KademliaCore
+	conns   []*net.UDPConn
+	sources sourceAddresses
+	timeout time.Duration
+	retries int
+
+	mu      sync.Mutex
+	pending map[ID]*udpPending
+	// replies to recent requests, resent when a retransmission arrives
+	// instead of running the handler (and its replay check) again
+	replies map[ID]*udpCachedReply
+	done    chan bool
+	closing sync.Once
+}
+
+// A request waiting for its reply, which must come from one of the addresses
+// it was sent to.
+type udpPending struct {
+	ch   chan interface{}
+	sent []*net.UDPAddr
+}
+
+type udpCachedReply struct {
+	data []byte // nil while the request is being handled
+	at   time.Time
+}
+
+// Listen for UDP on the same addresses as the TCP listeners. Nothing is read
+// until Start is called.
+func NewUDPTransport(core *KademliaCore, listeners []net.Listener, timeout time.Duration, retries int) (*UDPTransport, error) {
+	t := &UDPTransport{core: core, timeout: timeout, retries: retries}
+	t.pending = make(map[ID]*udpPending)
+	t.replies = make(map[ID]*udpCachedReply)
+	t.done = make(chan bool)
+	t.sources = listenerSources(listeners)
+	for _, l := range listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.conns = append(t.conns, conn)
+	}
+	return t, nil
+}
+
+// Start serving requests, once the node behind core is ready for them.
+func (t *UDPTransport) Start() {
+	for _, conn := range t.conns {
+		go t.serve(conn)
+	}
+	go t.sweep()
+}
+
+func (t *UDPTransport) Close() {
+	t.closing.Do(func() { close(t.done) })
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// How long a reply is kept for retransmissions of its request.
+func (t *UDPTransport) replyWindow() time.Duration {
+	return t.timeout * time.Duration(2*t.retries)
+}
+
+// Drop the replies no retransmission can ask for any more.
+func (t *UDPTransport) sweep() {
+	tick := time.NewTicker(t.replyWindow())
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			t.mu.Lock()
+			for id, cached := range t.replies {
+				if now.Sub(cached.at) > t.replyWindow() {
+					delete(t.replies, id)
+				}
+			}
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *UDPTransport) serve(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := unmarshalUDP(buf[:n], t.core.kademlia.Config.K)
+		if err != nil {
+			continue
+		}
+		switch m := msg.(type) {
+		case PingMessage, StoreRequest, FindNodeRequest, FindValueRequest:
+			if data, seen := t.seen(requestMsgID(m)); seen {
+				if data != nil {
+					conn.WriteToUDP(data, from)
+				}
+				continue
+			}
+			go t.handle(conn, from, m)
+		default:
+			t.deliver(m, from)
+		}
+	}
+}
+
+// Run a request through the KademliaCore handlers and send back the reply.
+func (t *UDPTransport) handle(conn *net.UDPConn, to *net.UDPAddr, msg interface{}) {
+	core := &KademliaCore{t.core.kademlia, to.IP}
+	var reply interface{}
+	var msgId ID
+	var err error
+	switch m := msg.(type) {
+	case PingMessage:
+		var pong PongMessage
+		err = core.Ping(m, &pong)
+		msgId, reply = m.MsgID, pong
+	case StoreRequest:
+		var res StoreResult
+		err = core.Store(m, &res)
+		msgId, reply = m.MsgID, res
+	case FindNodeRequest:
+		var res FindNodeResult
+		err = core.FindNode(m, &res)
+		msgId, reply = m.MsgID, res
+	case FindValueRequest:
+		var res FindValueResult
+		err = core.FindValue(m, &res)
+		msgId, reply = m.MsgID, res
+	}
+	if err != nil {
+		reply = udpErrorReply{msgId, err.Error()}
+	}
+	data, err := marshalUDP(reply)
+	if err == errUDPTooLarge {
+		// the sender retries over TCP under a fresh MsgID
+		data, err = marshalUDP(udpTooLargeReply{msgId})
+	}
+	if err == nil {
+		t.mu.Lock()
+		if cached, ok := t.replies[msgId]; ok {
+			cached.data = data
+		}
+		t.mu.Unlock()
+		conn.WriteToUDP(data, to)
+	}
+}
+
+// Report whether a request was seen recently, returning the reply sent for it
+// if any. Unseen requests are recorded as being handled.
+func (t *UDPTransport) seen(msgId ID) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cached, ok := t.replies[msgId]; ok {
+		return cached.data, true
+	}
+	t.replies[msgId] = &udpCachedReply{nil, time.Now()}
+	return nil, false
+}
+
+func requestMsgID(msg interface{}) ID {
+	switch m := msg.(type) {
+	case PingMessage:
+		return m.MsgID
+	case StoreRequest:
+		return m.MsgID
+	case FindNodeRequest:
+		return m.MsgID
+	case FindValueRequest:
+		return m.MsgID
+	}
+	return ID{}
+}
+
+// Return a copy of a request carrying msgId instead.
+func withMsgID(msg interface{}, msgId ID) interface{} {
+	switch m := msg.(type) {
+	case PingMessage:
+		m.MsgID = msgId
+		return m
+	case StoreRequest:
+		m.MsgID = msgId
+		return m
+	case FindNodeRequest:
+		m.MsgID = msgId
+		return m
+	case FindValueRequest:
+		m.MsgID = msgId
+		return m
+	}
+	return msg
+}
+
+func replyMsgID(msg interface{}) ID {
+	switch m := msg.(type) {
+	case PongMessage:
+		return m.MsgID
+	case StoreResult:
+		return m.MsgID
+	case FindNodeResult:
+		return m.MsgID
+	case FindValueResult:
+		return m.MsgID
+	case udpErrorReply:
+		return m.MsgID
+	case udpTooLargeReply:
+		return m.MsgID
+	}
+	return ID{}
+}
+
+// Hand a reply to the request waiting for it. Replies from addresses the
+// request was not sent to are dropped, a MsgID alone is easy to guess.
+func (t *UDPTransport) deliver(msg interface{}, from *net.UDPAddr) {
+	t.mu.Lock()
+	p, ok := t.pending[replyMsgID(msg)]
+	if ok {
+		ok = false
+		for _, each := range p.sent {
+			if each.IP.Equal(from.IP) && each.Port == from.Port {
+				ok = true
+			}
+		}
+	}
+	t.mu.Unlock()
+	if ok {
+		select {
+		case p.ch <- msg:
+		default:
+			// duplicate reply to a retransmission
+		}
+	}
+}
+
+// Pick the socket bound to the source address for the destination, else one
+// of the same address family.
+func (t *UDPTransport) connFor(ip net.IP) *net.UDPConn {
+	if source := t.sources.pick(ip); source != nil {
+		for _, conn := range t.conns {
+			if conn.LocalAddr().(*net.UDPAddr).IP.Equal(source) {
+				return conn
+			}
+		}
+	}
+	for _, conn := range t.conns {
+		local := conn.LocalAddr().(*net.UDPAddr).IP
+		if local.IsUnspecified() || (local.To4() != nil) == (ip.To4() != nil) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// Send a request to each address in turn, retransmitting on timeout, and
+// decode the reply into res. Returns errUDPFallback if the request should be
+// sent over TCP instead.
+func (t *UDPTransport) Call(addrs []Address, msgId ID, req interface{}, res interface{}) error {
+	data, err := marshalUDP(req)
+	if err != nil {
+		return errUDPFallback
+	}
+	p := &udpPending{ch: make(chan interface{}, 1)}
+	t.mu.Lock()
+	t.pending[msgId] = p
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, msgId)
+		t.mu.Unlock()
+	}()
+
+	for _, a := range addrs {
+		conn := t.connFor(a.Host)
+		if conn == nil {
+			continue
+		}
+		to := &net.UDPAddr{IP: a.Host, Port: int(a.Port)}
+		t.mu.Lock()
+		p.sent = append(p.sent, to)
+		t.mu.Unlock()
+		for attempt := 0; attempt < t.retries; attempt++ {
+			if _, err := conn.WriteToUDP(data, to); err != nil {
+				break
+			}
+			select {
+			case reply := <-p.ch:
+				return copyReply(reply, res)
+			case <-time.After(t.timeout):
+			}
+		}
+	}
+	return errUDPFallback
+}
+
+func copyReply(reply interface{}, res interface{}) error {
+	switch m := reply.(type) {
+	case udpErrorReply:
+		return rpc.ServerError(m.Message)
+	case udpTooLargeReply:
+		return errUDPFallback
+	case PongMessage:
+		if r, ok := res.(*PongMessage); ok {
+			*r = m
+			return nil
+		}
+	case StoreResult:
+		if r, ok := res.(*StoreResult); ok {
+			*r = m
+			return nil
+		}
+	case FindNodeResult:
+		if r, ok := res.(*FindNodeResult); ok {
+			*r = m
+			return nil
+		}
+	case FindValueResult:
+		if r, ok := res.(*FindValueResult); ok {
+			*r = m
+			return nil
+		}
+	}
+	return errors.New("unexpected UDP reply")
+}
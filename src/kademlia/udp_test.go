@@ -0,0 +1,165 @@
+package kademlia
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_UDPCodec(t *testing.T) {
+	sender := Contact{NewRandomID(), net.IPv4(127, 0, 0, 1), 7000, []Address{
+		{net.IPv4(127, 0, 0, 1), 7000},
+		{net.IPv6loopback, 7000},
+	}}
+	msgId := NewRandomID()
+	key := NewRandomID()
+	messages := []interface{}{
+		PingMessage{sender, msgId, CapUDP | CapErrorCodes, NewEnvelope()},
+		PongMessage{msgId, sender, CapErrorCodes, NewEnvelope()},
+		StoreRequest{sender, msgId, key, []byte("value"), true, time.Minute, NewEnvelope()},
+		FindNodeRequest{sender, msgId, key, NewEnvelope()},
+		StoreResult{msgId, []Contact{}, RPCError{}, 12, NewEnvelope()},
+		StoreResult{msgId, []Contact{}, RPCError{CodeBanned, "banned"}, 0, NewEnvelope()},
+		StoreResult{msgId, []Contact{sender}, RPCError{CodeNotResponsible, "far"}, 0, NewEnvelope()},
+		FindNodeResult{msgId, []Contact{sender, sender}, RPCError{}, NewEnvelope()},
+		FindValueRequest{sender, msgId, key, NewEnvelope()},
+		FindValueResult{msgId, []byte("value"), nil, RPCError{}, false, NewEnvelope()},
+		FindValueResult{msgId, []byte("cached"), nil, RPCError{}, true, NewEnvelope()},
+		FindValueResult{msgId, nil, []Contact{sender}, RPCError{}, false, NewEnvelope()},
+	}
+	for _, msg := range messages {
+		data, err := marshalUDP(msg)
+		assertTrue(err == nil, "Could not encode message", t)
+		decoded, err := unmarshalUDP(data, k)
+		assertTrue(err == nil, "Could not decode message", t)
+		again, _ := marshalUDP(decoded)
+		assertTrue(bytes.Equal(data, again), "Message changed by round trip", t)
+	}
+
+	_, err := unmarshalUDP([]byte{udpMagic, udpPing, 1, 2}, k)
+	assertTrue(err != nil, "Truncated datagram accepted", t)
+
+	big := StoreRequest{sender, msgId, key, make([]byte, udpMaxPacket), false, 0, NewEnvelope()}
+	_, err = marshalUDP(big)
+	assertTrue(err == errUDPTooLarge, "Oversized message not refused", t)
+}
+
+// Counts and lengths on the wire must not wrap when encoding, nor make the
+// decoder allocate for more than the packet can hold.
+func Test_UDPCodecBounds(t *testing.T) {
+	msgId := NewRandomID()
+	var buf bytes.Buffer
+	writeHeader(&buf, udpFindNodeReply, msgId, NewEnvelope())
+	writeRPCError(&buf, RPCError{})
+	buf.Write([]byte{0xff, 0xff})
+	_, err := unmarshalUDP(buf.Bytes(), k)
+	assertTrue(err != nil, "Contact count beyond the packet accepted", t)
+
+	many := Contact{NewRandomID(), net.IPv4(10, 0, 0, 1), 7000, nil}
+	for i := 0; i < 300; i++ {
+		many.Addrs = append(many.Addrs, Address{net.IPv4(10, 0, byte(i>>8), byte(i)), 7000})
+	}
+	buf.Reset()
+	writeContact(&buf, many)
+	u := &udpReader{r: bytes.NewReader(buf.Bytes()), k: k}
+	decoded := u.contact()
+	assertTrue(u.err == nil, "Contact with many addresses not decoded", t)
+	assertIntEqual(udpMaxAddrs, len(decoded.Addrs), "Address count wrapped", t)
+
+	long := StoreRequest{many, msgId, NewRandomID(), []byte("v"), true, 100 * 24 * time.Hour, NewEnvelope()}
+	long.Sender.Addrs = nil
+	data, _ := marshalUDP(long)
+	m, err := unmarshalUDP(data, k)
+	assertTrue(err == nil, "Store with a long TTL not decoded", t)
+	assertTrue(m.(StoreRequest).TTL > 40*24*time.Hour, "TTL wrapped", t)
+}
+
+// A reply must come from an address the request went to, whatever its MsgID.
+func Test_UDPReplyFromOtherAddress(t *testing.T) {
+	tr := &UDPTransport{pending: make(map[ID]*udpPending)}
+	msgId := NewRandomID()
+	p := &udpPending{ch: make(chan interface{}, 1)}
+	p.sent = append(p.sent, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000})
+	tr.pending[msgId] = p
+	tr.deliver(PongMessage{MsgID: msgId}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 7000})
+	assertIntEqual(0, len(p.ch), "Reply from another address delivered", t)
+	tr.deliver(PongMessage{MsgID: msgId}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000})
+	assertIntEqual(1, len(p.ch), "Reply from the address asked not delivered", t)
+}
+
+/*
+ * Two UDP-enabled nodes should talk over UDP, and a value too large for one
+ * datagram should still be stored through the TCP fallback.
+ */
+func Test_UDPTransport(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UDP = true
+	k1 := NewKademliaWithConfig("localhost:7966", conf)
+	k2 := NewKademliaWithConfig("localhost:7967", conf)
+
+	var pong PongMessage
+	msgId := NewRandomID()
+	err := k1.udp.Call(k2.SelfContact.Addresses(), msgId,
+		PingMessage{k1.SelfContact, msgId, k1.Capabilities(), NewEnvelope()}, &pong)
+	assertTrue(err == nil, "UDP ping failed", t)
+	assertTrue(pong.Sender.NodeID.Equals(k2.NodeID), "UDP pong from wrong node", t)
+
+	assertContains(
+		k1.DoPingAddresses(k2.SelfContact.Addresses()),
+		"OK: Ping "+k2.NodeID.AsString(),
+		"Cannot ping over UDP",
+		t)
+	key := NewRandomID()
+	assertContains(k1.DoStore(&k2.SelfContact, key, []byte("small")), "OK:", "UDP store failed", t)
+	assertContains(k1.DoFindValue(&k2.SelfContact, key), "small", "UDP find_value failed", t)
+	metrics := udpMetrics(k1)
+	assertContains(metrics, `kademlia_udp_requests_total{method="Store",result="ok"} 1`,
+		"Store not sent over UDP", t)
+	assertContains(metrics, `kademlia_udp_requests_total{method="FindValue",result="ok"} 1`,
+		"FindValue not sent over UDP", t)
+
+	bigKey := NewRandomID()
+	big := bytes.Repeat([]byte("x"), 2*udpMaxPacket)
+	assertContains(k1.DoStore(&k2.SelfContact, bigKey, big), "OK:", "Large store did not fall back", t)
+	assertContains(k1.DoFindValue(&k2.SelfContact, bigKey), string(big), "Large value not found over TCP", t)
+	assertContains(udpMetrics(k1), `kademlia_udp_requests_total{method="Store",result="fallback"} 1`,
+		"Large store fallback not counted", t)
+}
+
+func udpMetrics(k *Kademlia) string {
+	var buf bytes.Buffer
+	k.Metrics.WriteText(&buf)
+	return buf.String()
+}
+
+/*
+ * When the reply to a request handled over UDP is lost, the TCP retry must
+ * not be refused as a replay of it.
+ */
+func Test_UDPFallbackAfterLostReply(t *testing.T) {
+	conf := DefaultConfig()
+	conf.UDP = true
+	k1 := NewKademliaWithConfig("localhost:7985", conf)
+	k2 := NewKademliaWithConfig("localhost:7986", conf)
+
+	msgId := NewRandomID()
+	req := StoreRequest{k1.SelfContact, msgId, NewRandomID(), []byte("lost"), false, 0, NewEnvelope()}
+	var res StoreResult
+	err := k1.udp.Call(k2.SelfContact.Addresses(), msgId, req, &res)
+	assertTrue(err == nil, "UDP store failed", t)
+	// the peer has handled the request, but its reply never comes back
+	k1.udp.Close()
+
+	sent := msgId
+	res = StoreResult{}
+	err = k1.callAddresses(CapUDP, k2.SelfContact.Addresses(), "Store", &sent, req, &res)
+	assertTrue(err == nil && res.Err.Err() == nil, "TCP retry refused", t)
+	assertTrue(sent != msgId, "TCP retry reused the MsgID", t)
+	assertTrue(res.MsgID == sent, "Reply does not answer the retry", t)
+	assertContains(udpMetrics(k1), `kademlia_udp_requests_total{method="Store",result="fallback"} 1`,
+		"Fallback not counted", t)
+	for _, p := range k2.Reputation.Peers() {
+		assertIntEqual(0, p.Violations[ReplayedRequest], "Retry penalised as a replay", t)
+	}
+}
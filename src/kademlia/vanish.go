@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 	mathrand "math/rand"
 	"sss"
@@ -18,6 +19,7 @@ type VanashingDataObject struct {
 	Timeout    byte
 }
 
+// Epoch length in seconds, the default for Config.EpochRange.
 const EPOCH_RANGE = int64(3600 * 8)
 
 func GenerateRandomCryptoKey() (ret []byte) {
@@ -44,8 +46,8 @@ func CalculateSharedKeyLocations(accessKey, count, epoch int64) (ids []ID) {
 	return
 }
 
-func currentEpoch() int64 {
-	return time.Now().Unix() / EPOCH_RANGE
+func currentEpoch(clock Clock, epochRange time.Duration) int64 {
+	return clock.Now().Unix() / int64(epochRange/time.Second)
 }
 
 func encrypt(key []byte, text []byte) (ciphertext []byte) {
@@ -102,7 +104,7 @@ func distributeShares(kadem Kademlia, numberKeys, threshold byte, key []byte, ac
 	locations := CalculateSharedKeyLocations(
 		accessKey,
 		int64(numberKeys),
-		currentEpoch(),
+		currentEpoch(kadem.Clock, kadem.Config.EpochRange),
 	)
 	for i := byte(0); i < numberKeys; i++ {
 		kadem.DoIterativeStore(locations[i], fullShares[i])
@@ -110,13 +112,20 @@ func distributeShares(kadem Kademlia, numberKeys, threshold byte, key []byte, ac
 }
 
 func Refresh(kadem Kademlia, vdo VanashingDataObject) {
-	for loops := int(vdo.Timeout) / 8; loops > 0; loops-- {
+	kadem.Metrics.VdoRefreshStarted()
+	defer kadem.Metrics.VdoRefreshStopped()
+	refresh := kadem.Config.VanishRefresh
+	for loops := int(time.Duration(vdo.Timeout) * time.Hour / refresh); loops > 0; loops-- {
 		select {
-		case <-time.After(time.Hour * 8):
+		case <-kadem.Clock.After(refresh):
 			key := retrieveKey(kadem, vdo)
+			ev := Event{Kind: EventVdoRefreshed, AccessKey: vdo.AccessKey}
 			if key != nil {
 				distributeShares(kadem, vdo.NumberKeys, vdo.Threshold, key, vdo.AccessKey)
+			} else {
+				ev.Err = errors.New("cannot get more than threshold shares")
 			}
+			kadem.Events.emit(ev)
 		}
 	}
 }
@@ -134,17 +143,17 @@ func UnvanishData(kadem Kademlia, vdo VanashingDataObject) (data []byte) {
 func retrieveKey(kadem Kademlia, vdo VanashingDataObject) (key []byte) {
 	threshold := int(vdo.Threshold)
 	var fullShares [][]byte
-	for i := range []int{0, -1, 1} {
+	for _, i := range []int{0, -1, 1} {
 		locations := CalculateSharedKeyLocations(
 			vdo.AccessKey,
 			int64(vdo.NumberKeys),
-			currentEpoch()+int64(i),
+			currentEpoch(kadem.Clock, kadem.Config.EpochRange)+int64(i),
 		)
 		fullShares = make([][]byte, 0)
 		for _, each := range locations {
 			_, value := kadem.iterativeFindValue(each)
-			if value != "" {
-				fullShares = append(fullShares, []byte(value))
+			if value != nil {
+				fullShares = append(fullShares, value)
 			}
 			if len(fullShares) >= threshold {
 				break
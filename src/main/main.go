@@ -10,13 +10,16 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
-	"net/rpc"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -31,44 +34,146 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	// Get the bind and connect connection strings from command-line arguments.
+	// The listen address may be a comma-separated list to listen on several
+	// interfaces. Any arguments after it are seeds; with no seeds the node
+	// starts a new network.
+	seedFile := flag.String("seeds", "", "file with one seed host:port per line")
+	configFile := flag.String("config", "", "JSON file with protocol parameters")
+	logLevel := flag.String("log-level", "off", "debug, info, warn, error or off")
+	logJSON := flag.Bool("log-json", false, "write log lines as JSON")
+	logFile := flag.String("log-file", "", "append log lines to this file instead of stderr")
+	adminAddr := flag.String("admin", "", "serve the HTTP/JSON admin gateway on this host:port")
+	controlPath := flag.String("control", "", "accept CLI commands on a Unix socket at this path")
+	daemon := flag.Bool("daemon", false, "do not read commands from stdin, only from -control")
+	identityFile := flag.String("identity", "", "keep the node ID and known contacts in this file across restarts")
+	dataFile := flag.String("data", "", "load local values from this archive on start and save them on quit")
+	conf := kademlia.DefaultConfig()
+	conf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	if *configFile != "" {
+		conf = loadConfig(*configFile)
+	}
 	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatal("Must be invoked with exactly two arguments!\n")
+	if len(args) < 1 {
+		log.Fatal("Must be invoked with a listen address and optional seeds!\n")
+	}
+	if *daemon && *controlPath == "" {
+		log.Fatal("-daemon needs a -control socket")
 	}
 	listenStr := args[0]
-	firstPeerStr := args[1]
+	seeds := args[1:]
+	if *seedFile != "" {
+		fileSeeds, err := kademlia.ReadSeedFile(*seedFile)
+		if err != nil {
+			log.Fatal("Seeds: ", err)
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+	if *identityFile != "" {
+		// -id, on the command line or in the config file, overrides the file
+		ident, err := kademlia.LoadIdentity(*identityFile, conf.NodeID)
+		if err != nil {
+			log.Fatal("Identity: ", err)
+		}
+		conf.NodeID = ident.NodeID
+		seeds = append(seeds, ident.Contacts...)
+	}
 
 	// Create the Kademlia instance
 	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia(listenStr)
+	conf.Logger = newLogger(*logLevel, *logJSON, *logFile)
+	kadem := kademlia.NewKademliaWithConfig(listenStr, conf)
+	if *adminAddr != "" {
+		l, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatal("Admin: ", err)
+		}
+		go http.Serve(l, kadem.AdminHandler())
+	}
+	if *dataFile != "" {
+		if _, err := os.Stat(*dataFile); err == nil {
+			if _, _, err = kadem.ImportFile(*dataFile); err != nil {
+				log.Fatal("Data: ", err)
+			}
+		}
+	}
 
-	// Confirm our server is up with a PING request and then exit.
-	// Your code should loop forever, reading instructions from stdin and
-	// printing their results to stdout. See README.txt for more details.
-	_, port, _ := net.SplitHostPort(firstPeerStr)
-	client, err := rpc.DialHTTPPath("tcp", firstPeerStr, rpc.DefaultRPCPath+port)
+	// Join the network through the seeds, then loop forever reading
+	// instructions from stdin and printing their results to stdout.
+	result, err := kadem.Bootstrap(seeds)
+	fields := []kademlia.Field{
+		kademlia.F("seeds", result.Seeds),
+		kademlia.F("reached", result.Reached),
+		kademlia.F("contacts", result.Contacts),
+		kademlia.F("refreshed", result.Refreshed),
+	}
 	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+		kadem.Logger.Error("bootstrap failed", append(fields, kademlia.F("err", err))...)
+	} else {
+		kadem.Logger.Info("bootstrap done", fields...)
 	}
+	saveState(kadem, *identityFile, "")
 
-	ping := new(kademlia.PingMessage)
-	ping.MsgID = kademlia.NewRandomID()
-	ping.Sender = kadem.SelfContact
-	var pong kademlia.PongMessage
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-	if err != nil {
-		log.Fatal("Call: ", err)
+	// Commands come from stdin, the control socket or both; a quit from
+	// either, SIGINT or SIGTERM stops the node.
+	quit := make(chan bool, 3)
+	go quitOnSignal(quit)
+	if *controlPath != "" {
+		l, err := kademlia.ListenControl(*controlPath)
+		if err != nil {
+			log.Fatal("Control: ", err)
+		}
+		defer l.Close()
+		go func() {
+			kademlia.ServeControl(l, func(line string) string {
+				return executeLine(kadem, line)
+			})
+			quit <- true
+		}()
 	}
-	kadem.AddrBook.Update(pong.Sender)
-	log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	log.Printf("pong msgID: %s\n", pong.MsgID.AsString())
+	if !*daemon {
+		go readCommands(kadem, quit)
+	}
+	<-quit
+	saveState(kadem, *identityFile, *dataFile)
+	fmt.Printf("%v\n", kadem.DoLeave())
+}
 
+// Quit on the first SIGINT or SIGTERM, and exit at once on the second, in case
+// leaving the network takes too long.
+func quitOnSignal(quit chan bool) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	quit <- true
+	<-signals
+	os.Exit(1)
+}
+
+// Write the identity and data files, whichever were given, so the next start
+// resumes from here.
+func saveState(kadem *kademlia.Kademlia, identityFile, dataFile string) {
+	if identityFile != "" {
+		if err := kadem.SaveIdentity(identityFile); err != nil {
+			kadem.Logger.Error("saving identity failed", kademlia.F("err", err))
+		}
+	}
+	if dataFile != "" {
+		if err := kadem.ExportFile(dataFile); err != nil {
+			kadem.Logger.Error("saving data failed", kademlia.F("err", err))
+		}
+	}
+}
+
+func readCommands(kadem *kademlia.Kademlia, quit chan bool) {
 	in := bufio.NewReader(os.Stdin)
-	quit := false
-	for !quit {
+	for {
 		line, err := in.ReadString('\n')
-		if err != nil {
+		if err == io.EOF && line == "" {
+			// stdin closed, keep serving until a signal arrives
+			return
+		}
+		if err != nil && err != io.EOF {
 			log.Fatal(err)
 		}
 		line = strings.TrimSpace(line)
@@ -77,13 +182,53 @@ func main() {
 		}
 		resp := executeLine(kadem, line)
 		if resp == "quit" {
-			quit = true
+			quit <- true
+			return
 		} else if resp != "" {
 			fmt.Printf("%v\n", resp)
 		}
 	}
 }
 
+func newLogger(level string, asJSON bool, path string) kademlia.Logger {
+	l, err := kademlia.ParseLevel(level)
+	if err != nil {
+		log.Fatal("Log: ", err)
+	}
+	if l == kademlia.LevelOff {
+		return kademlia.QuietLogger{}
+	}
+	if path == "" {
+		return kademlia.NewLogger(os.Stderr, l, asJSON)
+	}
+	logger, err := kademlia.NewFileLogger(path, l, asJSON)
+	if err != nil {
+		log.Fatal("Log: ", err)
+	}
+	return logger
+}
+
+// Load a config file, then apply any flags given explicitly on the command
+// line on top of it.
+func loadConfig(path string) kademlia.Config {
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	conf, err := kademlia.LoadConfig(path)
+	if err != nil {
+		log.Fatal("Config: ", err)
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	conf.RegisterFlags(fs)
+	for name, value := range set {
+		if fs.Lookup(name) != nil {
+			fs.Set(name, value)
+		}
+	}
+	return conf
+}
+
 func executeLine(k *kademlia.Kademlia, line string) (response string) {
 	toks := strings.Fields(line)
 	switch {
@@ -114,6 +259,13 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		response = "OK: NodeID=" + toks[1] + "\n"
 		response += "      Host=" + c.Host.String() + "\n"
 		response += "      Port=" + strconv.Itoa(int(c.Port))
+		for _, each := range c.Addrs {
+			response += "\n      Addr=" + each.String()
+		}
+		if info, ok := k.AddrBook.PeerInfo(id); ok {
+			response += "\n      Version=" + strconv.Itoa(int(info.Version))
+			response += "\n      Capabilities=" + info.Capabilities.String()
+		}
 	case toks[0] == "ping":
 		// Do a ping
 		//
@@ -128,29 +280,21 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		id, err := kademlia.IDFromString(toks[1])
 		if err != nil {
-			hostname, portstr, err := net.SplitHostPort(toks[1])
+			_, portstr, err := net.SplitHostPort(toks[1])
 			if err != nil {
 				response = "ERR: Not a valid Node ID or host:port address"
 				return
 			}
-			port, err := strconv.Atoi(portstr)
-			if err != nil {
+			if _, err := strconv.Atoi(portstr); err != nil {
 				response = "ERR: Not a valid Node ID or host:port address"
 				return
 			}
-			ipAddrStrings, err := net.LookupHost(hostname)
+			addrs, err := kademlia.ResolveAddresses(toks[1])
 			if err != nil {
 				response = "ERR: Could not find the provided hostname"
 				return
 			}
-			var host net.IP
-			for i := 0; i < len(ipAddrStrings); i++ {
-				host = net.ParseIP(ipAddrStrings[i])
-				if host.To4() != nil {
-					break
-				}
-			}
-			response = k.DoPing(host, uint16(port))
+			response = k.DoPingAddresses(addrs)
 			return
 		}
 		c, err := k.FindContact(id)
@@ -158,7 +302,7 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Not a valid Node ID or host:port address"
 			return
 		}
-		response = k.DoPing(c.Host, c.Port)
+		response = k.DoPingAddresses(c.Addresses())
 
 	case toks[0] == "local_find_value":
 		// print a local variable
@@ -173,6 +317,88 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response = k.LocalFindValue(key)
 
+	case toks[0] == "local_keys":
+		if len(toks) > 1 {
+			response = "usage: local_keys"
+			return
+		}
+		response = k.DoLocalKeys()
+
+	case toks[0] == "export":
+		if len(toks) != 2 {
+			response = "usage: export [file]"
+			return
+		}
+		response = k.DoExport(toks[1])
+
+	case toks[0] == "import":
+		if len(toks) != 2 {
+			response = "usage: import [file]"
+			return
+		}
+		response = k.DoImport(toks[1])
+
+	case toks[0] == "bulk_store" || toks[0] == "bulk_verify":
+		if len(toks) < 2 || len(toks) > 4 {
+			response = "usage: " + toks[0] + " [file] [parallelism] [retries]"
+			return
+		}
+		parallelism, retries := 8, 3
+		var err error
+		if len(toks) > 2 {
+			if parallelism, err = strconv.Atoi(toks[2]); err != nil || parallelism < 1 {
+				response = "ERR: Not a valid parallelism (" + toks[2] + ")"
+				return
+			}
+		}
+		if len(toks) > 3 {
+			if retries, err = strconv.Atoi(toks[3]); err != nil || retries < 1 {
+				response = "ERR: Not a valid number of retries (" + toks[3] + ")"
+				return
+			}
+		}
+		if toks[0] == "bulk_store" {
+			response = k.DoBulkStore(toks[1], parallelism, retries)
+		} else {
+			response = k.DoBulkVerify(toks[1], parallelism, retries)
+		}
+
+	case toks[0] == "hot_keys":
+		if len(toks) > 1 {
+			response = "usage: hot_keys"
+			return
+		}
+		response = k.DoHotKeys()
+
+	case toks[0] == "peers":
+		if len(toks) > 1 {
+			response = "usage: peers"
+			return
+		}
+		response = k.DoPeers()
+
+	case toks[0] == "ban":
+		if len(toks) < 2 || len(toks) > 3 {
+			response = "usage: ban [nodeID | IP] [duration]"
+			return
+		}
+		var d time.Duration
+		if len(toks) == 3 {
+			var err error
+			if d, err = time.ParseDuration(toks[2]); err != nil || d <= 0 {
+				response = "ERR: Not a valid duration (" + toks[2] + ")"
+				return
+			}
+		}
+		response = k.DoBan(toks[1], d)
+
+	case toks[0] == "unban":
+		if len(toks) != 2 {
+			response = "usage: unban [nodeID | IP]"
+			return
+		}
+		response = k.DoUnban(toks[1])
+
 	case toks[0] == "store":
 		// Store key, value pair at NodeID
 		if len(toks) < 4 || len(toks) > 4 {